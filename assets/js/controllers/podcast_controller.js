@@ -10,7 +10,7 @@ export default class extends Controller {
 
     unlistenedEls() {
         return this.episodeTargets.filter(ep => {
-            return ep.dataset.episodeListened !== 'true'
+            return ep.dataset.episodeListened !== 'true' && ep.dataset.episodeRemoved !== 'true'
         })
     }
 
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/charlesharries/podcast-stats/pkg/forms"
+	"github.com/charlesharries/podcast-stats/pkg/models"
+	"github.com/jinzhu/gorm"
+)
+
+// The reasons we can't subscribe someone to a feed URL.
+var (
+	ErrInvalidFeedURL  = errors.New("invalid feed URL")
+	ErrNotAFeed        = errors.New("not a podcast feed")
+	ErrFeedUnavailable = errors.New("feed unavailable")
+)
+
+// subscribeSchemes are the schemes podcast apps use for subscribe links.
+// They don't say whether the feed itself is on HTTP or HTTPS, so we ask
+// for HTTP and let the server redirect us.
+var subscribeSchemes = []string{"feed", "itpc", "pcast", "podcast"}
+
+// normalizeFeedURL tidies up a feed URL someone has given us, so that
+// subscribe links and URLs without a scheme work, and checks that it's
+// something we can fetch.
+func normalizeFeedURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+
+	for _, scheme := range subscribeSchemes {
+		if len(raw) > len(scheme) && strings.EqualFold(raw[:len(scheme)+1], scheme+":") {
+			raw = strings.TrimPrefix(raw[len(scheme)+1:], "//")
+			break
+		}
+	}
+
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidFeedURL, err)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return "", fmt.Errorf("%w: %s", ErrInvalidFeedURL, raw)
+	}
+
+	return u.String(), nil
+}
+
+// checkFeed fetches a feed to make sure it's a podcast we can follow. It
+// returns the podcast's name, and the feed's URL after any permanent
+// redirects.
+func (f *fetcher) checkFeed(ctx context.Context, feedURL string) (string, string, error) {
+	fetch, err := f.fetchFeed(ctx, models.Podcast{Feed: feedURL})
+	if errors.Is(err, ErrUnknownFeedFormat) {
+		return "", "", fmt.Errorf("%w: %s", ErrNotAFeed, err)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s", ErrFeedUnavailable, err)
+	}
+
+	details := fetch.Feed.Channel.details()
+	if details.Title == "" && len(fetch.Feed.Channel.Items) == 0 {
+		return "", "", fmt.Errorf("%w: no title or episodes", ErrNotAFeed)
+	}
+
+	if fetch.MovedTo != "" {
+		feedURL = fetch.MovedTo
+	}
+
+	name := details.Title
+	if name == "" {
+		u, _ := url.Parse(feedURL)
+		name = u.Hostname()
+	}
+
+	return name, feedURL, nil
+}
+
+// feedURLProblem gets the message to show someone whose feed URL we
+// couldn't subscribe them to. It's false if the problem is on our side.
+func feedURLProblem(err error) (string, bool) {
+	switch {
+	case errors.Is(err, ErrInvalidFeedURL):
+		return "Please enter a valid feed URL.", true
+	case errors.Is(err, ErrNotAFeed):
+		return "That doesn't look like a podcast feed.", true
+	case errors.Is(err, ErrFeedUnavailable):
+		return "We couldn't fetch that feed. Check the URL and try again.", true
+	case errors.Is(err, ErrPrivateFeedsOff):
+		return "Private feeds aren't available at the moment.", true
+	default:
+		return "", false
+	}
+}
+
+// feedRequest is a feed someone has asked to subscribe to by its URL.
+// Feeds that need a username and password can be given them separately or
+// in the URL, and either way they're private, as are feeds which are only
+// asked to be.
+type feedRequest struct {
+	URL      string
+	Username string
+	Password string
+	Private  bool
+}
+
+// newFeedRequest reads a feed request from the add feed form.
+func newFeedRequest(form *forms.Form) feedRequest {
+	return feedRequest{
+		URL:      form.Get("feedURL"),
+		Username: form.Get("username"),
+		Password: form.Get("password"),
+		Private:  form.Get("private") != "",
+	}
+}
+
+// feedURL tidies up the requested feed URL, adding any credentials, and
+// works out whether the feed needs to be private.
+func (f feedRequest) feedURL() (string, bool, error) {
+	feedURL, err := normalizeFeedURL(f.URL)
+	if err != nil {
+		return "", f.Private, err
+	}
+
+	feedURL, err = withCredentials(feedURL, f.Username, f.Password)
+	if err != nil {
+		return "", f.Private, err
+	}
+
+	return feedURL, f.Private || hasCredentials(feedURL), nil
+}
+
+// String describes the requested feed for logs, without giving away
+// anything about private feeds but their host. URLs we can't read might
+// have credentials in them that we can't find, so they're never logged.
+func (f feedRequest) String() string {
+	feedURL, private, err := f.feedURL()
+	switch {
+	case err != nil:
+		return "invalid feed URL"
+	case private:
+		return feedLabel(feedURL)
+	default:
+		return fmt.Sprintf("%q", f.URL)
+	}
+}
+
+// podcastFromFeed finds or creates the podcast for a feed someone has
+// asked for. Feeds we don't have yet are fetched first, so we only ever
+// save podcasts whose feeds work. Private feeds are never shared, so the
+// user gets their own copy of the podcast.
+func (app *application) podcastFromFeed(ctx context.Context, userID uint, req feedRequest) (models.Podcast, error) {
+	feedURL, private, err := req.feedURL()
+	if err != nil {
+		return models.Podcast{}, err
+	}
+
+	if private {
+		return app.privatePodcast(ctx, userID, feedURL)
+	}
+
+	podcast, err := app.podcasts.FindByFeed(feedURL)
+	if err == nil || !gorm.IsRecordNotFoundError(err) {
+		return podcast, err
+	}
+
+	name, feedURL, err := app.fetcher.checkFeed(ctx, feedURL)
+	if err != nil {
+		return models.Podcast{}, err
+	}
+
+	return app.podcasts.CreateFromFeed(name, feedURL)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestNormalizeFeedURL tests that we can subscribe to feed URLs however
+// they've been pasted in, and turn away ones we can't fetch.
+func TestNormalizeFeedURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"HTTPS", "https://example.com/feed.xml", "https://example.com/feed.xml", false},
+		{"Whitespace", "  https://example.com/feed.xml\n", "https://example.com/feed.xml", false},
+		{"No scheme", "example.com/feed.xml", "http://example.com/feed.xml", false},
+		{"Upper case scheme", "HTTPS://example.com/feed.xml", "https://example.com/feed.xml", false},
+		{"feed://", "feed://example.com/feed.xml", "http://example.com/feed.xml", false},
+		{"feed:https://", "feed:https://example.com/feed.xml", "https://example.com/feed.xml", false},
+		{"itpc://", "itpc://example.com/feed.xml", "http://example.com/feed.xml", false},
+		{"Host starting with feed", "feeds.example.com/show", "http://feeds.example.com/show", false},
+		{"FTP", "ftp://example.com/feed.xml", "", true},
+		{"No host", "https:///feed.xml", "", true},
+		{"Empty", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeFeedURL(tt.raw)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidFeedURL) {
+					t.Errorf("want %s, got %v", ErrInvalidFeedURL, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestCheckFeed tests that we only accept feed URLs that actually serve a
+// podcast feed.
+func TestCheckFeed(t *testing.T) {
+	feed := newTestFeedServer(t, rssFixture(3))
+	defer feed.Close()
+
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<!DOCTYPE html><html><body>Not a feed</body></html>"))
+	}))
+	defer page.Close()
+
+	empty := newTestFeedServer(t, `<rss><channel></channel></rss>`)
+	defer empty.Close()
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	name, feedURL, err := newTestFetcher().checkFeed(context.Background(), feed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "Test Podcast" {
+		t.Errorf("want %q, got %q", "Test Podcast", name)
+	}
+
+	if feedURL != feed.URL {
+		t.Errorf("want %q, got %q", feed.URL, feedURL)
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		want error
+	}{
+		{"HTML page", page.URL, ErrNotAFeed},
+		{"Empty channel", empty.URL, ErrNotAFeed},
+		{"Not found", missing.URL, ErrFeedUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := newTestFetcher().checkFeed(context.Background(), tt.url)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("want %s, got %v", tt.want, err)
+			}
+		})
+	}
+}
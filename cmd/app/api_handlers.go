@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/charlesharries/podcast-stats/pkg/forms"
+	"github.com/jinzhu/gorm"
 )
 
 // apiOK returns a JSON response indicating that the request was successful.
@@ -53,27 +57,139 @@ func (app *application) apiSubscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Nobody but its owner can subscribe to a private podcast.
+	podcast, err := app.podcasts.Get(collectionID)
+	if err == nil && !podcast.VisibleTo(currentUser.ID) {
+		app.apiClientError(w, http.StatusNotFound, "Podcast not found.")
+		return
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		app.apiServerError(w, err)
+		return
+	}
+
 	err = app.subscriptions.Create(collectionID, currentUser.ID)
 	if err != nil {
 		app.apiServerError(w, err)
 		return
 	}
 
-	// Save the episodes of the newly subscribed podcast in the background.
-	go func(collectionID int) {
-		episodes, err := app.getEpisodes(collectionID)
-		if err != nil {
+	// Save the full history of the newly subscribed podcast in the background.
+	app.backfillPodcast(collectionID)
+
+	app.apiOK(w, r)
+}
+
+// apiSubscribeFeed subscribes the currently logged in user to a podcast
+// by its feed URL, and responds with the podcast's ID.
+func (app *application) apiSubscribeFeed(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("feedURL")
+	if !form.Valid() {
+		app.apiClientError(w, http.StatusUnprocessableEntity, "Feed URL is required.")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), app.fetcher.Timeout)
+	defer cancel()
+
+	currentUser := app.session.Get(r, "authenticatedUser").(TemplateUser)
+	req := newFeedRequest(form)
+
+	podcast, err := app.podcastFromFeed(ctx, currentUser.ID, req)
+	if err != nil {
+		if msg, ok := feedURLProblem(err); ok {
+			app.infoLog.Printf("warning: subscribing to %s: %s", req, err)
+			app.apiClientError(w, http.StatusUnprocessableEntity, msg)
+		} else {
 			app.apiServerError(w, err)
+		}
+
+		return
+	}
+
+	err = app.subscriptions.Create(podcast.ID, currentUser.ID)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	// Save the full history of the newly subscribed podcast in the background.
+	app.backfillPodcast(podcast.ID)
+
+	js, err := json.Marshal(map[string]interface{}{
+		"error":     false,
+		"message":   "ok",
+		"podcastID": podcast.ID,
+		"name":      podcast.Name,
+	})
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// apiImportSubscriptions subscribes the currently logged in user to every
+// podcast in an OPML file, and responds with how each one went. The file
+// can either be uploaded as "opml" or sent as the request body.
+func (app *application) apiImportSubscriptions(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxOPMLSize)
+
+	var body io.Reader = r.Body
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err := r.ParseMultipartForm(maxOPMLSize)
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest)
 			return
 		}
 
-		err = app.saveEpisodes(collectionID, episodes)
+		file, _, err := r.FormFile("opml")
 		if err != nil {
-			app.apiServerError(w, err)
+			app.apiClientError(w, http.StatusUnprocessableEntity, "OPML file is required.")
+			return
 		}
-	}(collectionID)
+		defer file.Close()
 
-	app.apiOK(w, r)
+		body = file
+	}
+
+	entries, err := parseOPML(body)
+	if err != nil {
+		app.infoLog.Printf("warning: importing OPML: %s", err)
+		app.apiClientError(w, http.StatusUnprocessableEntity, "That doesn't look like an OPML file.")
+		return
+	}
+
+	currentUser := app.session.Get(r, "authenticatedUser").(TemplateUser)
+
+	results, err := app.importOPML(r.Context(), currentUser.ID, entries)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	js, err := json.Marshal(map[string]interface{}{
+		"error":   false,
+		"message": importSummary(results),
+		"results": results,
+	})
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
 // unsubscribe removes a user's podcast subscription.
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// AtomFeed is a full Atom document.
+type AtomFeed struct {
+	XMLName  xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string       `xml:"title"`
+	Subtitle string       `xml:"subtitle"`
+	Updated  string       `xml:"updated"`
+	Authors  []AtomAuthor `xml:"author"`
+	Links    []AtomLink   `xml:"link"`
+	Logo     string       `xml:"logo"`
+	Icon     string       `xml:"icon"`
+	Entries  []AtomEntry  `xml:"entry"`
+}
+
+// AtomAuthor is the author of an Atom feed.
+type AtomAuthor struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email"`
+}
+
+// AtomEntry is a single entry in an Atom feed. Podcasts published as
+// Atom tend to use the iTunes namespace too, so we read the same iTunes
+// fields as we do for RSS items.
+type AtomEntry struct {
+	ID            string     `xml:"id"`
+	ITunesTitle   string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd title"`
+	Title         string     `xml:"title"`
+	Published     string     `xml:"published"`
+	Updated       string     `xml:"updated"`
+	Links         []AtomLink `xml:"link"`
+	Duration      string     `xml:"duration"`
+	EpisodeNumber string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episode"`
+	Season        string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd season"`
+	EpisodeType   string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episodeType"`
+	Explicit      string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd explicit"`
+	Image         FeedImage  `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+	ITunesSummary string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd summary"`
+	Summary       string     `xml:"summary"`
+	Content       string     `xml:"content"`
+}
+
+// AtomLink is a link from an Atom entry. Episode audio is linked with
+// rel="enclosure".
+type AtomLink struct {
+	Rel    string `xml:"rel,attr"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr"`
+	Length string `xml:"length,attr"`
+}
+
+// enclosure finds the entry's enclosure link, if it has one.
+func (e *AtomEntry) enclosure() AtomLink {
+	for _, l := range e.Links {
+		if strings.TrimSpace(l.Rel) == "enclosure" {
+			return l
+		}
+	}
+
+	return AtomLink{}
+}
+
+// toFeedEpisode normalizes an Atom entry into the same shape as an RSS
+// item, so it can be saved the same way.
+func (e *AtomEntry) toFeedEpisode() FeedEpisode {
+	published := e.Published
+	if strings.TrimSpace(published) == "" {
+		published = e.Updated
+	}
+
+	enclosure := e.enclosure()
+
+	return FeedEpisode{
+		ITunesTitle: e.ITunesTitle,
+		Title:       e.Title,
+		GUID:        strings.TrimSpace(e.ID),
+		PublishedOn: published,
+		Source: FeedSource{
+			URL:    enclosure.Href,
+			Length: enclosure.Length,
+			Type:   enclosure.Type,
+		},
+		Duration:       e.Duration,
+		EpisodeNumber:  e.EpisodeNumber,
+		Season:         e.Season,
+		EpisodeType:    e.EpisodeType,
+		Explicit:       e.Explicit,
+		Image:          e.Image,
+		Summary:        e.ITunesSummary,
+		ContentEncoded: e.Content,
+		Description:    e.Summary,
+	}
+}
+
+// toFeedResults normalizes an Atom feed into the same shape as an RSS
+// feed.
+func (f *AtomFeed) toFeedResults() FeedResults {
+	var items []FeedEpisode
+	for _, e := range f.Entries {
+		items = append(items, e.toFeedEpisode())
+	}
+
+	channel := FeedChannel{
+		Title:         f.Title,
+		Description:   f.Subtitle,
+		Image:         FeedChannelImage{URL: firstNonEmpty(f.Logo, f.Icon)},
+		LastBuildDate: f.Updated,
+		AtomLinks:     f.Links,
+		Items:         items,
+	}
+
+	if len(f.Authors) > 0 {
+		channel.Author = f.Authors[0].Name
+		channel.Owner = FeedOwner{Name: f.Authors[0].Name, Email: f.Authors[0].Email}
+	}
+
+	// The website is the alternate link, which is the default kind.
+	for _, l := range f.Links {
+		if rel := strings.TrimSpace(l.Rel); rel == "" || rel == "alternate" {
+			channel.Link = l.Href
+			break
+		}
+	}
+
+	return FeedResults{Channel: channel}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestParseFeedAtom tests that an Atom feed is detected and its entries
+// normalized into episodes.
+func TestParseFeedAtom(t *testing.T) {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+	<feed xmlns="http://www.w3.org/2005/Atom" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+		<title>Atom Podcast</title>
+		<entry>
+			<id>urn:uuid:1225c695-cfb8-4ebb-aaaa-80da344efa6a</id>
+			<title>First episode</title>
+			<updated>2020-06-04T09:00:00Z</updated>
+			<published>2020-06-03T11:05:30Z</published>
+			<link rel="alternate" href="https://example.com/1"/>
+			<link rel="enclosure" href="https://example.com/1.mp3" type="audio/mpeg" length="1234"/>
+			<itunes:duration>45:00</itunes:duration>
+			<summary>What happens.</summary>
+		</entry>
+		<entry>
+			<id>urn:uuid:2</id>
+			<title>Second episode</title>
+			<updated>2020-06-10T09:00:00Z</updated>
+			<link rel="enclosure" href="https://example.com/2.mp3"/>
+		</entry>
+	</feed>`
+
+	feed, err := decodeFeed("application/atom+xml", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(feed.Channel.Items) != 2 {
+		t.Fatalf("want %d, got %d episodes", 2, len(feed.Channel.Items))
+	}
+
+	first := feed.Channel.Items[0]
+	if first.GUID != "urn:uuid:1225c695-cfb8-4ebb-aaaa-80da344efa6a" {
+		t.Errorf("want GUID from entry id, got %q", first.GUID)
+	}
+
+	if first.Source.URL != "https://example.com/1.mp3" || first.Source.Length != "1234" {
+		t.Errorf("want enclosure link, got %+v", first.Source)
+	}
+
+	if dur, _ := first.duration(); dur != 45*60 {
+		t.Errorf("want duration %d, got %d", 45*60, dur)
+	}
+
+	if first.description() != "What happens." {
+		t.Errorf("want summary as description, got %q", first.description())
+	}
+
+	pub, err := first.publishedOnTime()
+	if err != nil || pub.Day() != 3 {
+		t.Errorf("want published date, got %s (%v)", pub, err)
+	}
+
+	// Entries without a published date fall back to updated.
+	pub, err = feed.Channel.Items[1].publishedOnTime()
+	if err != nil || pub.Day() != 10 {
+		t.Errorf("want updated date, got %s (%v)", pub, err)
+	}
+}
+
+// TestParseFeedUnknown tests that we reject documents that aren't feeds.
+func TestParseFeedUnknown(t *testing.T) {
+	_, err := decodeFeed("application/atom+xml", strings.NewReader(`<html><body>Not a feed</body></html>`))
+	if !errors.Is(err, ErrUnknownFeedFormat) {
+		t.Errorf("want ErrUnknownFeedFormat, got %v", err)
+	}
+}
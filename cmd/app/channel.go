@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// FeedOwner is the itunes:owner of a podcast.
+type FeedOwner struct {
+	Name  string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd name"`
+	Email string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd email"`
+}
+
+// FeedCategory is an itunes:category, which can have subcategories.
+type FeedCategory struct {
+	Text          string         `xml:"text,attr"`
+	Subcategories []FeedCategory `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd category"`
+}
+
+// FeedChannelImage is the RSS image for a channel, which keeps its URL in
+// a child element rather than an attribute.
+type FeedChannelImage struct {
+	URL string `xml:"url"`
+}
+
+// firstNonEmpty gets the first of its arguments that isn't blank, trimmed.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// categories lists the channel's categories, with subcategories written
+// as "Parent > Child". iTunes categories are used if there are any,
+// otherwise plain RSS ones.
+func (c *FeedChannel) categories() []string {
+	var names []string
+
+	for _, cat := range c.ITunesCategories {
+		parent := strings.TrimSpace(cat.Text)
+		if parent == "" {
+			continue
+		}
+		names = append(names, parent)
+
+		for _, sub := range cat.Subcategories {
+			if child := strings.TrimSpace(sub.Text); child != "" {
+				names = append(names, parent+" > "+child)
+			}
+		}
+	}
+
+	if len(names) > 0 {
+		return names
+	}
+
+	for _, cat := range c.Categories {
+		if cat = strings.TrimSpace(cat); cat != "" {
+			names = append(names, cat)
+		}
+	}
+
+	return names
+}
+
+// details gets the podcast details from the channel, for storing against
+// the podcast.
+func (c *FeedChannel) details() models.Podcast {
+	podcast := models.Podcast{
+		Title:       firstNonEmpty(c.Title, c.ITunesTitle),
+		Description: firstNonEmpty(c.Description, c.Summary),
+		Author:      firstNonEmpty(c.Author, c.ManagingEditor),
+		OwnerName:   strings.TrimSpace(c.Owner.Name),
+		OwnerEmail:  strings.TrimSpace(c.Owner.Email),
+		Link:        strings.TrimSpace(c.Link),
+		Language:    strings.TrimSpace(c.Language),
+		Categories:  strings.Join(c.categories(), ", "),
+		Explicit:    parseExplicit(c.Explicit),
+		ArtworkURL:  firstNonEmpty(c.ITunesImage.Href, c.Image.URL),
+		PodcastGUID: strings.TrimSpace(c.PodcastGUID),
+	}
+
+	if t, err := parsePubDate(c.LastBuildDate); err == nil {
+		podcast.LastBuildDate = &t
+	}
+
+	return podcast
+}
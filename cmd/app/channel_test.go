@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+// TestChannelDetails tests that we read the podcast's details from its
+// feed's channel.
+func TestChannelDetails(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0"
+	xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"
+	xmlns:atom="http://www.w3.org/2005/Atom">
+<channel>
+	<title>The Show</title>
+	<itunes:title>The Show (iTunes)</itunes:title>
+	<atom:link href="https://example.com/feed.xml" rel="self" type="application/rss+xml"/>
+	<link>https://example.com</link>
+	<description>&lt;p&gt;A show about things.&lt;/p&gt;</description>
+	<language>en-gb</language>
+	<lastBuildDate>Wed, 03 Jun 2020 11:05:30 GMT</lastBuildDate>
+	<itunes:author>Jo Bloggs</itunes:author>
+	<itunes:owner>
+		<itunes:name>Example Media</itunes:name>
+		<itunes:email>podcasts@example.com</itunes:email>
+	</itunes:owner>
+	<itunes:image href="https://example.com/art.jpg"/>
+	<image><url>https://example.com/small.jpg</url></image>
+	<itunes:category text="Arts">
+		<itunes:category text="Books"/>
+	</itunes:category>
+	<itunes:category text="Comedy"/>
+	<category>Ignored</category>
+	<itunes:explicit>yes</itunes:explicit>
+</channel>
+</rss>`
+
+	var feed FeedResults
+	err := xml.Unmarshal([]byte(body), &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := feed.Channel.details()
+
+	checks := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"Title", got.Title, "The Show"},
+		{"Description", got.Description, "<p>A show about things.</p>"},
+		{"Author", got.Author, "Jo Bloggs"},
+		{"Owner name", got.OwnerName, "Example Media"},
+		{"Owner email", got.OwnerEmail, "podcasts@example.com"},
+		{"Link", got.Link, "https://example.com"},
+		{"Language", got.Language, "en-gb"},
+		{"Categories", got.Categories, "Arts, Arts > Books, Comedy"},
+		{"Artwork", got.ArtworkURL, "https://example.com/art.jpg"},
+	}
+
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: want %q, got %q", c.name, c.want, c.got)
+		}
+	}
+
+	if !got.Explicit {
+		t.Error("want explicit, got not explicit")
+	}
+
+	wantBuild := time.Date(2020, time.June, 3, 11, 5, 30, 0, time.UTC)
+	if got.LastBuildDate == nil || !got.LastBuildDate.Equal(wantBuild) {
+		t.Errorf("want %s, got %v", wantBuild, got.LastBuildDate)
+	}
+}
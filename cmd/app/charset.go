@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// windows1252 maps the bytes 0x80 to 0x9f in Windows-1252 to the runes
+// they stand for. Every other byte means the same as in ISO-8859-1, which
+// is the same as its Unicode code point. Undefined bytes are left as the
+// code point with the same value, as browsers do.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+// legacyReader converts text in a single-byte legacy encoding to UTF-8 as
+// it's read.
+type legacyReader struct {
+	r       io.Reader
+	decode  func(b byte) rune
+	in      []byte
+	pending []byte
+}
+
+// Read fills p with UTF-8, converting from the legacy encoding.
+func (l *legacyReader) Read(p []byte) (int, error) {
+	for len(l.pending) == 0 {
+		if l.in == nil {
+			l.in = make([]byte, 4096)
+		}
+
+		n, err := l.r.Read(l.in)
+		for _, b := range l.in[:n] {
+			l.pending = appendRune(l.pending, l.decode(b))
+		}
+
+		if n == 0 && err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+
+	return n, nil
+}
+
+// appendRune adds the UTF-8 encoding of r to b.
+func appendRune(b []byte, r rune) []byte {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+
+	return append(b, buf[:n]...)
+}
+
+// decodeWindows1252 reads a byte of Windows-1252.
+func decodeWindows1252(b byte) rune {
+	if b >= 0x80 && b <= 0x9f {
+		return windows1252[b-0x80]
+	}
+
+	return rune(b)
+}
+
+// charsetReader converts a feed in the given charset to UTF-8, for use as
+// an xml.Decoder's CharsetReader. We only know the legacy encodings that
+// feeds actually turn up in. ISO-8859-1 is read as Windows-1252, since
+// that's almost always what's really meant.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "windows-1252", "cp1252", "x-cp1252", "iso-8859-1", "iso8859-1", "iso_8859-1", "latin1", "latin-1", "l1":
+		return &legacyReader{r: input, decode: decodeWindows1252}, nil
+	default:
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+}
+
+// xmlEncoding matches the encoding in an XML declaration.
+var xmlEncoding = regexp.MustCompile(`^\s*<\?xml[^>]*encoding\s*=`)
+
+// contentCharset gets the charset from a Content-Type header, if there
+// is one.
+func contentCharset(contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	return params["charset"]
+}
+
+// needsHeaderCharset checks whether we need to go by the charset in the
+// Content-Type header, because the document doesn't declare its own
+// encoding and so would otherwise be read as UTF-8.
+func needsHeaderCharset(head []byte, contentType string) bool {
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	if xmlEncoding.Match(head) {
+		return false
+	}
+
+	switch strings.ToLower(contentCharset(contentType)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return false
+	default:
+		return true
+	}
+}
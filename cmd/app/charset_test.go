@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestDecodeFeedCharsets tests that feeds in legacy encodings are
+// converted to UTF-8, whether the encoding is declared in the feed or
+// only in its content type.
+func TestDecodeFeedCharsets(t *testing.T) {
+	// "Café – “Live”" in Windows-1252.
+	title := "Caf\xe9 \x96 \x93Live\x94"
+	want := "Café – “Live”"
+
+	tests := []struct {
+		name        string
+		contentType string
+		prolog      string
+	}{
+		{"Declared Windows-1252", "application/rss+xml", `<?xml version="1.0" encoding="windows-1252"?>`},
+		{"Declared ISO-8859-1", "application/rss+xml", `<?xml version="1.0" encoding="ISO-8859-1"?>`},
+		{"Content type only", "application/rss+xml; charset=windows-1252", `<?xml version="1.0"?>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.prolog + `<rss><channel><item><title>` + title + `</title></item></channel></rss>`
+
+			feed, err := decodeFeed(tt.contentType, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := feed.Channel.Items[0].Title
+			if got != want {
+				t.Errorf("want %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+// TestDecodeFeedEntities tests that HTML entities, which aren't valid in
+// XML, don't stop a feed being read.
+func TestDecodeFeedEntities(t *testing.T) {
+	body := `<rss><channel><item><title>Fish&nbsp;&amp;&nbsp;chips &eacute;t&eacute; &bogus;</title></item></channel></rss>`
+
+	feed, err := decodeFeed("application/rss+xml", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Fish & chips été &bogus;"
+	got := feed.Channel.Items[0].Title
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// TestCharsetReaderUnsupported tests that we refuse charsets we can't
+// convert rather than reading them as UTF-8.
+func TestCharsetReaderUnsupported(t *testing.T) {
+	_, err := charsetReader("shift_jis", strings.NewReader(""))
+	if err == nil {
+		t.Error("want error, got nil")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DurationError is returned when an episode's duration isn't in any of the
+// formats we know how to read.
+type DurationError struct {
+	Value string
+}
+
+// Error describes the duration that couldn't be parsed.
+func (e *DurationError) Error() string {
+	return fmt.Sprintf("unrecognised duration %q", e.Value)
+}
+
+// durationUnits maps the units we see in textual durations, like "45 min"
+// or "1h 2m", to a number of seconds.
+var durationUnits = map[string]float64{
+	"h":       3600,
+	"hr":      3600,
+	"hrs":     3600,
+	"hour":    3600,
+	"hours":   3600,
+	"m":       60,
+	"min":     60,
+	"mins":    60,
+	"minute":  60,
+	"minutes": 60,
+	"s":       1,
+	"sec":     1,
+	"secs":    1,
+	"second":  1,
+	"seconds": 1,
+}
+
+// parseDuration reads an episode's duration in seconds. Feeds are meant to
+// use either a number of seconds or HH:MM:SS, but we also accept
+// fractional seconds, commas as decimal points, ISO 8601 durations like
+// "PT1H2M" and textual durations like "45 min" or "1 hr 2 mins". An empty
+// duration is 0. Anything else is a *DurationError.
+func parseDuration(value string) (int, error) {
+	s := strings.ToLower(strings.TrimSpace(value))
+	if s == "" {
+		return 0, nil
+	}
+
+	s = strings.Replace(s, ",", ".", -1)
+
+	var secs float64
+	var ok bool
+
+	switch {
+	case strings.Contains(s, ":"):
+		secs, ok = clockSeconds(s)
+	case strings.HasPrefix(s, "pt"):
+		secs, ok = unitSeconds(s[2:])
+	default:
+		secs, ok = plainSeconds(s)
+		if !ok {
+			secs, ok = unitSeconds(s)
+		}
+	}
+
+	if !ok || secs < 0 || math.IsInf(secs, 0) || math.IsNaN(secs) {
+		return 0, &DurationError{Value: value}
+	}
+
+	return int(math.Round(secs)), nil
+}
+
+// plainSeconds reads a bare number of seconds, which might have a
+// fractional part.
+func plainSeconds(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return f, true
+}
+
+// clockSeconds reads HH:MM:SS, MM:SS or even DD:HH:MM:SS, where the last
+// part might have a fractional part.
+func clockSeconds(s string) (float64, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 4 {
+		return 0, false
+	}
+
+	multipliers := []float64{1, 60, 3600, 86400}
+
+	var total float64
+	for i := range parts {
+		part := strings.TrimSpace(parts[len(parts)-1-i])
+
+		// Allow empty leading parts, as in ":45".
+		if part == "" && i == len(parts)-1 && i > 0 {
+			continue
+		}
+
+		// Only the seconds can have a fractional part.
+		if i > 0 && strings.Contains(part, ".") {
+			return 0, false
+		}
+
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		total += f * multipliers[i]
+	}
+
+	return total, true
+}
+
+// unitSeconds reads a duration made up of numbers and units, with or
+// without spaces between them, like "1h2m3s", "45 min" or
+// "1 hour, 2 minutes".
+func unitSeconds(s string) (float64, bool) {
+	var total float64
+	var number string
+	found := false
+
+	tokens := durationTokens(s)
+	for _, token := range tokens {
+		if token == "and" {
+			continue
+		}
+
+		if unicode.IsDigit(rune(token[0])) {
+			if number != "" {
+				return 0, false
+			}
+			number = token
+			continue
+		}
+
+		unit, ok := durationUnits[token]
+		if !ok || number == "" {
+			return 0, false
+		}
+
+		f, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		total += f * unit
+		number = ""
+		found = true
+	}
+
+	// A trailing number without a unit is seconds, as in "1m 30".
+	if number != "" {
+		if !found {
+			return 0, false
+		}
+
+		f, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		total += f
+	}
+
+	return total, found
+}
+
+// durationTokens splits a textual duration into numbers and words.
+func durationTokens(s string) []string {
+	var tokens []string
+	var current []rune
+	inNumber := false
+
+	flush := func() {
+		if len(current) > 0 {
+			tokens = append(tokens, string(current))
+			current = current[:0]
+		}
+	}
+
+	for _, r := range s {
+		switch {
+		case unicode.IsDigit(r) || (r == '.' && inNumber):
+			if !inNumber {
+				flush()
+			}
+			inNumber = true
+			current = append(current, r)
+		case unicode.IsLetter(r):
+			if inNumber {
+				flush()
+			}
+			inNumber = false
+			current = append(current, r)
+		default:
+			flush()
+			inNumber = false
+		}
+	}
+	flush()
+
+	return tokens
+}
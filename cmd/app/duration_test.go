@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestParseDuration tests the variations on episode durations that we
+// see in the wild.
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  int
+	}{
+		{"Empty", "", 0},
+		{"Seconds", "3723", 3723},
+		{"Fractional seconds", "3723.4", 3723},
+		{"Comma decimal", "3723,6", 3724},
+		{"HH:MM:SS", "01:02:03", 3723},
+		{"H:MM:SS", "1:02:03", 3723},
+		{"HH:MM:SS with fraction", "1:02:03.5", 3724},
+		{"MM:SS", "62:03", 3723},
+		{"Leading colon", ":45", 45},
+		{"Whitespace", " 1:02:03 ", 3723},
+		{"Minutes", "45 min", 2700},
+		{"Minutes without space", "45mins", 2700},
+		{"Hours and minutes", "1 hr 2 mins", 3720},
+		{"Long units", "1 hour, 2 minutes and 3 seconds", 3723},
+		{"Compact units", "1h2m3s", 3723},
+		{"Uppercase units", "1H 2M", 3720},
+		{"Trailing seconds", "1m 30", 90},
+		{"ISO 8601", "PT1H2M3S", 3723},
+		{"ISO 8601 fractional", "PT45M0.5S", 2701},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDuration(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("want %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestParseDurationInvalid tests that durations we can't read give a
+// *DurationError.
+func TestParseDurationInvalid(t *testing.T) {
+	for _, value := range []string{"soon", "1:2:3:4:5", "1.5:00", "45 fortnights", "min", "-30", "1::03"} {
+		t.Run(value, func(t *testing.T) {
+			_, err := parseDuration(value)
+
+			var durErr *DurationError
+			if !errors.As(err, &durErr) {
+				t.Errorf("want *DurationError, got %v", err)
+			}
+		})
+	}
+}
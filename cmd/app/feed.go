@@ -1,168 +1,867 @@
 package main
 
 import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
 )
 
-// FeedResults is the full XML response.
+// FeedResults is the full XML response. Feeds in other formats are
+// normalized into the same shape before they are saved.
 type FeedResults struct {
 	XMLName xml.Name    `xml:"rss"`
 	Channel FeedChannel `xml:"channel"`
 }
 
-// FeedChannel is the channel belonging to the feed.
+// FeedChannel is the channel belonging to the feed. As with items,
+// namespaced fields need to come before any un-namespaced fields with the
+// same name, which is how atom:link elements, where feeds advertise their
+// WebSub hub, are kept out of Link.
 type FeedChannel struct {
-	XMLName xml.Name      `xml:"channel"`
-	Items   []FeedEpisode `xml:"item"`
+	XMLName          xml.Name         `xml:"channel"`
+	ITunesTitle      string           `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd title"`
+	Title            string           `xml:"title"`
+	Description      string           `xml:"description"`
+	Summary          string           `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd summary"`
+	Author           string           `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd author"`
+	ManagingEditor   string           `xml:"managingEditor"`
+	Owner            FeedOwner        `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd owner"`
+	AtomLinks        []AtomLink       `xml:"http://www.w3.org/2005/Atom link"`
+	Link             string           `xml:"link"`
+	Language         string           `xml:"language"`
+	ITunesCategories []FeedCategory   `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd category"`
+	Categories       []string         `xml:"category"`
+	Explicit         string           `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd explicit"`
+	ITunesImage      FeedImage        `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+	Image            FeedChannelImage `xml:"image"`
+	LastBuildDate    string           `xml:"lastBuildDate"`
+	NewFeedURL       string           `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd new-feed-url"`
+	PodcastGUID      string           `xml:"https://podcastindex.org/namespace/1.0 guid"`
+	Persons          []FeedPerson     `xml:"https://podcastindex.org/namespace/1.0 person"`
+	Items            []FeedEpisode    `xml:"item"`
 }
 
-// FeedEpisode is a single episode from the feed.
+// FeedEpisode is a single episode from the feed. Namespaced fields need
+// to come before any un-namespaced fields with the same name, otherwise
+// the un-namespaced field will swallow both elements.
 type FeedEpisode struct {
-	XMLName     xml.Name   `xml:"item"`
-	Title       string     `xml:"title"`
-	GUID        string     `xml:"guid"`
-	PublishedOn string     `xml:"pubDate"`
-	Source      FeedSource `xml:"enclosure"`
-	Duration    string     `xml:"duration"`
+	XMLName        xml.Name   `xml:"item"`
+	ITunesTitle    string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd title"`
+	Title          string     `xml:"title"`
+	GUID           string     `xml:"guid"`
+	PublishedOn    string     `xml:"pubDate"`
+	Source         FeedSource `xml:"enclosure"`
+	Duration       string     `xml:"duration"`
+	EpisodeNumber  string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episode"`
+	Season         string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd season"`
+	EpisodeType    string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episodeType"`
+	Explicit       string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd explicit"`
+	Image          FeedImage  `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+	Summary        string     `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd summary"`
+	ContentEncoded string     `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	Description    string     `xml:"description"`
+
+	// Podcasting 2.0 fields.
+	Chapters      FeedChapters      `xml:"https://podcastindex.org/namespace/1.0 chapters"`
+	Transcripts   []FeedTranscript  `xml:"https://podcastindex.org/namespace/1.0 transcript"`
+	Persons       []FeedPerson      `xml:"https://podcastindex.org/namespace/1.0 person"`
+	PodcastSeason FeedPodcastSeason `xml:"https://podcastindex.org/namespace/1.0 season"`
 }
 
 // FeedSource is a episode URL.
 type FeedSource struct {
 	XMLName xml.Name `xml:"enclosure"`
 	URL     string   `xml:"url,attr"`
+	Length  string   `xml:"length,attr"`
+	Type    string   `xml:"type,attr"`
+}
+
+// FeedImage is an itunes:image, which keeps its URL in an attribute.
+type FeedImage struct {
+	Href string `xml:"href,attr"`
+}
+
+// title gets the episode's title, falling back to the iTunes title.
+func (ep *FeedEpisode) title() string {
+	if strings.TrimSpace(ep.Title) != "" {
+		return strings.TrimSpace(ep.Title)
+	}
+
+	return strings.TrimSpace(ep.ITunesTitle)
+}
+
+// description gets the episode's show notes, preferring the full
+// content:encoded version where there is one.
+func (ep *FeedEpisode) description() string {
+	if strings.TrimSpace(ep.ContentEncoded) != "" {
+		return strings.TrimSpace(ep.ContentEncoded)
+	}
+
+	return strings.TrimSpace(ep.Description)
+}
+
+// episodeType gets the itunes:episodeType, which is "full" unless the
+// feed says otherwise.
+func (ep *FeedEpisode) episodeType() string {
+	switch t := strings.ToLower(strings.TrimSpace(ep.EpisodeType)); t {
+	case "trailer", "bonus":
+		return t
+	default:
+		return "full"
+	}
+}
+
+// explicit checks the itunes:explicit flag, which feeds spell in a
+// few different ways.
+func (ep *FeedEpisode) explicit() bool {
+	return parseExplicit(ep.Explicit)
+}
+
+// parseExplicit reads an itunes:explicit value.
+func parseExplicit(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "true", "explicit":
+		return true
+	default:
+		return false
+	}
+}
+
+// atoiOrZero reads a number from a feed, treating anything unreadable
+// as 0.
+func atoiOrZero(value string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+// season gets the episode's season number, preferring iTunes but falling
+// back to podcast:season.
+func (ep *FeedEpisode) season() int {
+	if n := atoiOrZero(ep.Season); n > 0 {
+		return n
+	}
+
+	return atoiOrZero(ep.PodcastSeason.Number)
+}
+
+// key gets the key which identifies the episode within its podcast.
+func (ep *FeedEpisode) key() string {
+	return models.EpisodeKey(ep.GUID, ep.Source.URL, ep.title())
+}
+
+// toEpisode converts a feed item into the episode we store, given the
+// duration and publish date we've already worked out for it.
+func (ep *FeedEpisode) toEpisode(podcastID, duration int, publishedOn time.Time) models.Episode {
+	length, _ := strconv.ParseInt(strings.TrimSpace(ep.Source.Length), 10, 64)
+
+	var durationSource string
+	if duration > 0 {
+		durationSource = models.DurationFromFeed
+	}
+
+	return models.Episode{
+		PodcastID:       podcastID,
+		GUID:            strings.TrimSpace(ep.GUID),
+		ItemKey:         ep.key(),
+		Title:           ep.title(),
+		Source:          ep.Source.URL,
+		PublishedOn:     publishedOn,
+		Duration:        duration,
+		EpisodeNumber:   atoiOrZero(ep.EpisodeNumber),
+		Season:          ep.season(),
+		EpisodeType:     ep.episodeType(),
+		Explicit:        ep.explicit(),
+		ImageURL:        strings.TrimSpace(ep.Image.Href),
+		Summary:         strings.TrimSpace(ep.Summary),
+		Description:     ep.description(),
+		EnclosureLength: length,
+		EnclosureType:   strings.TrimSpace(ep.Source.Type),
+		SeasonName:      strings.TrimSpace(ep.PodcastSeason.Name),
+		ChaptersURL:     strings.TrimSpace(ep.Chapters.URL),
+		ChaptersType:    strings.TrimSpace(ep.Chapters.Type),
+		DurationSource:  durationSource,
+	}
 }
 
 // publishedOnTime gets a time.Time object for the episode's string time.
+// If the date can't be read, the error is a *PubDateError.
 func (ep *FeedEpisode) publishedOnTime() (time.Time, error) {
-	t, err := time.Parse("Mon, 02 Jan 2006 15:04:05 -0700", ep.PublishedOn)
-	if err == nil {
-		return t, nil
+	return parsePubDate(ep.PublishedOn)
+}
+
+// duration gets an episode's time in seconds. If the duration can't be
+// read, the error is a *DurationError.
+func (ep *FeedEpisode) duration() (int, error) {
+	return parseDuration(ep.Duration)
+}
+
+// feedFetch is the result of requesting a podcast's feed.
+type feedFetch struct {
+	Feed         FeedResults
+	ETag         string
+	LastModified string
+	Hash         string
+	NotModified  bool
+	MovedTo      string
+	Status       int
+	Links        map[string]string
+}
+
+// defaultMaxFeedSize is the most of a feed we'll read, after decompressing
+// it, if the fetcher doesn't say otherwise.
+const defaultMaxFeedSize = 50 << 20
+
+// ErrFeedTooLarge is returned when a feed is bigger than the fetcher's
+// MaxFeedSize.
+var ErrFeedTooLarge = errors.New("feed is too large")
+
+// limitedReader reads up to n bytes, then fails with ErrFeedTooLarge
+// rather than quietly stopping, so we never save half a feed.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying reader until the limit is passed.
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrFeedTooLarge
 	}
 
-	t, err = time.Parse("Mon, 02 Jan 2006 15:04:05 MST", ep.PublishedOn)
-	if err == nil {
-		return t, nil
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
 	}
 
-	t, err = time.Parse("Mon, 2 Jan 2006 15:04:05 -0700", ep.PublishedOn)
-	if err == nil {
-		return t, nil
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrFeedTooLarge
 	}
 
-	return t, nil
+	return n, err
 }
 
-// duration gets en episode's time in seconds.
-func (ep *FeedEpisode) duration() (int, error) {
-	// If no duration, just return 0
-	if len(ep.Duration) == 0 {
-		return 0, nil
+// decompress wraps a response body according to its Content-Encoding. We
+// ask for gzip and deflate ourselves, so Go won't decompress for us.
+// Deflate is meant to be zlib-wrapped, but some servers send it raw.
+func decompress(encoding string, body io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		br := bufio.NewReader(body)
+		header, _ := br.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
 	}
+}
+
+// fetchFeed requests and decodes a podcast's feed. The request is made
+// conditional on the validators from the last fetch, and if the server
+// says nothing has changed, or sends back exactly what we saw last time,
+// the result is marked NotModified and the feed is left empty. The feed is
+// decoded and hashed as it's read, so it's never held in memory whole,
+// and reading stops with ErrFeedTooLarge if it goes over MaxFeedSize.
+func (f *fetcher) fetchFeed(ctx context.Context, podcast models.Podcast) (feedFetch, error) {
+	var fetch feedFetch
 
-	// If duration doesn't have a :, it's likely already
-	// in seconds.
-	if !strings.Contains(ep.Duration, ":") {
-		d, err := strconv.Atoi(ep.Duration)
+	// Build the request for the feed...
+	req, err := http.NewRequestWithContext(ctx, "GET", podcast.Feed, nil)
+	if err != nil {
+		return fetch, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	// ... make it conditional if we've fetched it before...
+	if podcast.ETag != "" {
+		req.Header.Set("If-None-Match", podcast.ETag)
+	}
+	if podcast.LastModified != "" {
+		req.Header.Set("If-Modified-Since", podcast.LastModified)
+	}
+
+	// ... make the request, keeping track of any permanent redirects...
+	client := &http.Client{CheckRedirect: followPermanent(&fetch.MovedTo)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fetch, err
+	}
+	defer resp.Body.Close()
+
+	fetch.Status = resp.StatusCode
+
+	if resp.StatusCode == http.StatusNotModified {
+		fetch.ETag = podcast.ETag
+		fetch.LastModified = podcast.LastModified
+		fetch.Hash = podcast.FeedHash
+		fetch.NotModified = true
+		return fetch, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fetch, fmt.Errorf("fetching %s: %s", podcast.Feed, resp.Status)
+	}
+
+	fetch.ETag = resp.Header.Get("ETag")
+	fetch.LastModified = resp.Header.Get("Last-Modified")
+	fetch.Links = linkHeader(resp.Header.Values("Link"))
+
+	// ... decompress the body, hashing it as we read it...
+	body, err := decompress(resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil {
+		return fetch, err
+	}
+
+	hash := sha256.New()
+	body = io.TeeReader(&limitedReader{r: body, n: f.maxFeedSize()}, hash)
+
+	// ... decode it, whatever format it's in...
+	feed, err := decodeFeed(resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		return fetch, err
+	}
+
+	// ... and check whether it's any different to last time, which means
+	// reading whatever's left after the end of the feed. If it isn't, what
+	// we've decoded is thrown away.
+	_, err = io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return fetch, err
+	}
+
+	fetch.Hash = hex.EncodeToString(hash.Sum(nil))
+	if fetch.Hash == podcast.FeedHash {
+		fetch.NotModified = true
+		return fetch, nil
+	}
+
+	fetch.Feed = feed
+
+	return fetch, nil
+}
+
+// ErrUnknownFeedFormat is returned when a feed isn't RSS, Atom or
+// JSON Feed.
+var ErrUnknownFeedFormat = errors.New("unknown feed format")
+
+// decodeFeed works out the format of a feed, from its content type or its
+// root element, and normalizes it into FeedResults. XML feeds are decoded
+// leniently: legacy charsets are converted to UTF-8, whether they're
+// declared in the document or only in the content type, and HTML entities
+// like &nbsp; are understood.
+func decodeFeed(contentType string, r io.Reader) (FeedResults, error) {
+	var feed FeedResults
+
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(512)
+
+	if isJSONFeed(contentType, head) {
+		var jf JSONFeed
+		err := json.NewDecoder(br).Decode(&jf)
 		if err != nil {
-			fmt.Println(ep.Title, ep.Duration)
-			return 0, err
+			return feed, err
 		}
 
-		return d, nil
+		return jf.toFeedResults(), nil
 	}
 
-	// Slice apart the duration on :, then add up the
-	// seconds, minutes, and hours.
-	parts := strings.Split(ep.Duration, ":")
-	var s, m, h int
-	var sec, min, hour string
+	var input io.Reader = br
+	if needsHeaderCharset(head, contentType) {
+		var err error
+		input, err = charsetReader(contentCharset(contentType), br)
+		if err != nil {
+			return feed, err
+		}
+	}
+
+	d := xml.NewDecoder(input)
+	d.CharsetReader = charsetReader
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
 
-	sec, parts = parts[len(parts)-1], parts[:len(parts)-1]
-	s, err := strconv.Atoi(sec)
+	root, err := rootElement(d)
 	if err != nil {
-		return 0, err
+		return feed, err
 	}
 
-	if len(parts) > 0 {
-		min, parts = parts[len(parts)-1], parts[:len(parts)-1]
-		m, err = strconv.Atoi(min)
+	switch root.Name.Local {
+	case "rss":
+		err = d.DecodeElement(&feed, &root)
+		return feed, err
+	case "feed":
+		var atom AtomFeed
+		err = d.DecodeElement(&atom, &root)
 		if err != nil {
-			return 0, err
+			return feed, err
 		}
+
+		return atom.toFeedResults(), nil
+	default:
+		return feed, fmt.Errorf("%w: <%s>", ErrUnknownFeedFormat, root.Name.Local)
 	}
+}
 
-	if len(parts) > 0 {
-		hour, parts = parts[len(parts)-1], parts[:len(parts)-1]
-		h, err = strconv.Atoi(hour)
+// rootElement reads up to the first element in an XML document.
+func rootElement(d *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := d.Token()
 		if err != nil {
-			return 0, err
+			return xml.StartElement{}, err
 		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
+
+// saveEpisodes receives a list of episodes and saves them to the database.
+// Episodes we've already stored are only written again if something about
+// them has changed, so the first save of a feed backfills its whole history
+// and every save after that is incremental. A bad item doesn't stop the
+// rest of the feed being saved: items we can't save at all are skipped,
+// and items with a publish date or duration we can't read are saved with
+// the best value we have. Either way, they're listed in the report.
+//
+// If partial is set, eps are only some of the feed's items, like the new
+// entries a WebSub hub pushes to us, so episodes missing from them are
+// neither marked as removed nor matched up as reissues.
+func (app *application) saveEpisodes(podcastID int, eps []FeedEpisode, partial bool) (feedReport, error) {
+	report := feedReport{Items: len(eps)}
+
+	existing, err := app.episodes.FindByPodcast(podcastID)
+	if err != nil {
+		return report, err
 	}
 
-	return h*60*60 + m*60 + s, nil
+	stored := make(map[string]models.Episode, len(existing))
+	var episodeIDs []uint
+	for _, ep := range existing {
+		stored[ep.ItemKey] = ep
+		episodeIDs = append(episodeIDs, ep.ID)
+	}
+
+	people, transcripts, err := app.storedExtras(podcastID, episodeIDs)
+	if err != nil {
+		return report, err
+	}
+
+	// Items we skip still count as being in the feed, so they aren't
+	// marked as removed.
+	var orphans []models.Episode
+	if !partial {
+		orphans = orphanedEpisodes(existing, eps)
+	}
+	keys := map[string]bool{}
+
+	// Episodes to write, along with their people and transcripts, the
+	// ones that have been reissued, and what's changed about the ones we
+	// already had.
+	var pending []models.Episode
+	var extras []models.EpisodeExtras
+	var merges []models.EpisodeMerge
+	var revisions []models.EpisodeRevision
+	now := time.Now()
+
+	for _, ep := range eps {
+		if ep.GUID == "" && ep.Source.URL == "" && ep.title() == "" {
+			report.skip(ep, "no guid, enclosure or title to identify it by")
+			continue
+		}
+
+		key := ep.key()
+		if keys[key] {
+			report.skip(ep, "duplicate of an earlier item")
+			continue
+		}
+		keys[key] = true
+
+		s, seen := stored[key]
+
+		pub, pubErr := ep.publishedOnTime()
+		dur, durErr := ep.duration()
+
+		episode := ep.toEpisode(podcastID, dur, pub)
+
+		if problem, ok := oversized(episode); ok {
+			report.skip(ep, problem)
+			continue
+		}
+
+		// If the publisher has reissued this episode under a new GUID, carry
+		// on with the row we already have for it. Episodes we've already
+		// stored under this GUID have a row of their own.
+		if !seen {
+			if match, matchedBy, ok := matchReissued(orphans, episode); ok {
+				orphans = withoutEpisode(orphans, match.ID)
+
+				var merge models.EpisodeMerge
+				s, merge = mergeReissued(match, episode, matchedBy)
+				merges = append(merges, merge)
+
+				seen = true
+			}
+		}
+
+		// If we can't read the publish date, fall back to when we first saw
+		// the episode rather than storing a zero date.
+		if pubErr != nil {
+			episode.PublishedOn = now
+			if seen {
+				episode.PublishedOn = s.PublishedOn
+			}
+
+			report.degrade(ep, pubErr.Error())
+		}
+
+		// Likewise, keep whatever duration we had before.
+		if durErr != nil {
+			if seen {
+				episode.Duration = s.Duration
+				episode.DurationSource = s.DurationSource
+			}
+
+			report.degrade(ep, durErr.Error())
+		}
+
+		// Hang on to anything we've found out by probing the enclosure,
+		// unless the feed now tells us the duration itself, and to the
+		// chapters we've fetched, unless they've moved.
+		if seen {
+			episode.DurationProbedAt = s.DurationProbedAt
+
+			if s.ChaptersURL == episode.ChaptersURL {
+				episode.ChaptersFetchedAt = s.ChaptersFetchedAt
+			}
+
+			if episode.Duration == 0 && s.DurationSource == models.DurationProbed {
+				episode.Duration = s.Duration
+				episode.DurationSource = s.DurationSource
+			}
+		}
+
+		if seen && episodeUnchanged(s, episode) &&
+			peopleUnchanged(people[s.ID], toPeople(ep.Persons)) &&
+			transcriptsUnchanged(transcripts[s.ID], toTranscripts(ep.Transcripts)) {
+			report.Unchanged++
+			continue
+		}
+
+		if seen {
+			revisions = append(revisions, episodeRevisions(s, episode, now)...)
+		}
+
+		pending = append(pending, episode)
+		extras = append(extras, models.EpisodeExtras{
+			People:      toPeople(ep.Persons),
+			Transcripts: toTranscripts(ep.Transcripts),
+		})
+	}
+
+	// Anything left over has been pulled from the feed. An empty feed is
+	// more likely to be broken than to have had everything pulled, so we
+	// leave its episodes alone.
+	var removed []uint
+	if len(eps) > 0 {
+		for _, o := range orphans {
+			if o.RemovedAt == nil {
+				report.Removed++
+			}
+			removed = append(removed, o.ID)
+		}
+	}
+
+	// Write everything in one go, so a failure part way through doesn't
+	// leave the podcast half updated. The chapters and transcripts
+	// themselves can be slow to fetch, so that's done in the background.
+	err = app.episodes.SaveFeed(pending, extras, merges, revisions, removed)
+	if err != nil {
+		return report, err
+	}
+
+	for _, m := range merges {
+		app.infoLog.Printf("podcast %d: episode %d reissued as %q (%s)", m.PodcastID, m.EpisodeID, m.NewGUID, m.MatchedBy)
+	}
+
+	report.Saved = len(pending)
+
+	app.fetchExtrasLater(podcastID)
+
+	return report, nil
 }
 
-// getEpisodes fetches the first 20 episodes from an XML feed.
-func (app *application) getEpisodes(collectionID int) ([]FeedEpisode, error) {
-	var feed FeedResults
-	var blank []FeedEpisode
+// storedExtras gets the people and transcripts we've already stored for a
+// podcast's episodes, keyed by episode ID.
+func (app *application) storedExtras(podcastID int, episodeIDs []uint) (map[uint][]models.Person, map[uint][]models.Transcript, error) {
+	people := map[uint][]models.Person{}
+	transcripts := map[uint][]models.Transcript{}
+
+	if len(episodeIDs) == 0 {
+		return people, transcripts, nil
+	}
 
-	podcast, err := app.podcasts.Find(collectionID)
+	ps, err := app.people.FindByPodcast(podcastID)
 	if err != nil {
-		return blank, err
+		return people, transcripts, err
 	}
 
-	// Request the data from the feed...
-	resp, err := http.Get(podcast.Feed)
+	for _, p := range ps {
+		people[p.EpisodeID] = append(people[p.EpisodeID], p)
+	}
+
+	ts, err := app.transcripts.FindByEpisodeIDs(episodeIDs)
 	if err != nil {
-		return blank, err
+		return people, transcripts, err
 	}
-	defer resp.Body.Close()
 
-	// ... get the body...
-	body, err := ioutil.ReadAll(resp.Body)
+	for _, t := range ts {
+		transcripts[t.EpisodeID] = append(transcripts[t.EpisodeID], t)
+	}
+
+	return people, transcripts, nil
+}
+
+// episodeLimits are the most characters we can store in each of an
+// episode's columns that has a limit, other than ones we fill in ourselves.
+var episodeLimits = []struct {
+	name  string
+	limit int
+	value func(models.Episode) string
+}{
+	{"guid", 2048, func(ep models.Episode) string { return ep.GUID }},
+	{"enclosure type", 255, func(ep models.Episode) string { return ep.EnclosureType }},
+	{"season name", 255, func(ep models.Episode) string { return ep.SeasonName }},
+	{"chapters type", 255, func(ep models.Episode) string { return ep.ChaptersType }},
+}
+
+// oversized checks whether any of an episode's details are too long for
+// us to store, which would fail the whole feed's save.
+func oversized(episode models.Episode) (string, bool) {
+	for _, l := range episodeLimits {
+		if utf8.RuneCountInString(l.value(episode)) > l.limit {
+			return fmt.Sprintf("%s is longer than %d characters", l.name, l.limit), true
+		}
+	}
+
+	return "", false
+}
+
+// episodeUnchanged checks whether a stored episode already matches what
+// we've just read from the feed. An episode that had been removed from the
+// feed has changed by coming back.
+func episodeUnchanged(stored, fetched models.Episode) bool {
+	return (stored.RemovedAt == nil) == (fetched.RemovedAt == nil) &&
+		stored.Title == fetched.Title &&
+		stored.Source == fetched.Source &&
+		stored.Duration == fetched.Duration &&
+		stored.DurationSource == fetched.DurationSource &&
+		stored.PublishedOn.Equal(fetched.PublishedOn) &&
+		stored.EpisodeNumber == fetched.EpisodeNumber &&
+		stored.Season == fetched.Season &&
+		stored.EpisodeType == fetched.EpisodeType &&
+		stored.Explicit == fetched.Explicit &&
+		stored.ImageURL == fetched.ImageURL &&
+		stored.Summary == fetched.Summary &&
+		stored.Description == fetched.Description &&
+		stored.EnclosureLength == fetched.EnclosureLength &&
+		stored.EnclosureType == fetched.EnclosureType &&
+		stored.SeasonName == fetched.SeasonName &&
+		stored.ChaptersURL == fetched.ChaptersURL &&
+		stored.ChaptersType == fetched.ChaptersType
+}
+
+// refreshPodcast fetches a podcast's feed and saves any new or changed
+// episodes, then records how it went so we can tell when a feed is
+// broken. If the feed hasn't changed since we last fetched it, we don't
+// touch the episodes at all. It waits for any other refresh or push of the
+// same podcast to finish first.
+//
+// Private podcasts are fetched from their real feed URL, which is kept out
+// of any error we return or record.
+func (app *application) refreshPodcast(ctx context.Context, collectionID int) error {
+	unlock, err := app.fetcher.locks.lock(ctx, collectionID)
 	if err != nil {
-		return blank, err
+		return err
 	}
+	defer unlock()
 
-	// ... and unmarshal.
-	err = xml.Unmarshal(body, &feed)
+	podcast, err := app.podcasts.Get(collectionID)
 	if err != nil {
-		return blank, err
+		return err
+	}
+
+	var fetch feedFetch
+	var warnings []string
+
+	unsealed, err := app.unsealFeed(podcast)
+	if err == nil {
+		fetch, warnings, err = app.ingestFeed(ctx, unsealed)
 	}
 
-	toGet := 20
-	if len(feed.Channel.Items) < 20 {
-		toGet = len(feed.Channel.Items)
+	if podcast.Private() {
+		err = redactFeed(err, unsealed.Feed, podcast.Feed)
 	}
 
-	return feed.Channel.Items[:toGet], nil
+	recordErr := app.podcasts.RecordFetch(collectionID, models.FetchOutcome{
+		At:          time.Now(),
+		Status:      fetch.Status,
+		Err:         err,
+		NotModified: fetch.NotModified,
+		Warnings:    warnings,
+	})
+	if err != nil {
+		return err
+	}
+
+	return recordErr
 }
 
-// saveEpisodes receives a list of episodes and saves them to the database.
-func (app *application) saveEpisodes(podcastID int, eps []FeedEpisode) error {
-	for _, ep := range eps {
-		pub, err := ep.publishedOnTime()
+// ingestFeed does the work of refreshing a podcast: fetching its feed,
+// following it if it's moved, and saving what's changed. If the feed is
+// pushed from a WebSub hub, we make sure we're subscribed to it. Private
+// podcasts need to have been unsealed first.
+func (app *application) ingestFeed(ctx context.Context, podcast models.Podcast) (feedFetch, []string, error) {
+	fetch, err := app.fetcher.fetchFeed(ctx, podcast)
+	if err != nil {
+		return fetch, nil, err
+	}
+
+	// If the feed has permanently redirected, start using its new home.
+	if movedTo := movedURL(podcast, fetch.MovedTo); movedTo != "" && movedTo != podcast.Feed {
+		err = app.moveFeed(podcast, movedTo, models.FeedMoveRedirect)
 		if err != nil {
-			return err
+			return fetch, nil, err
 		}
 
-		dur, err := ep.duration()
-		if err != nil {
-			return err
+		podcast.Feed = movedTo
+	}
+
+	if fetch.NotModified {
+		return fetch, nil, nil
+	}
+
+	warnings, err := app.saveFeed(podcast, fetch)
+	if err != nil {
+		return fetch, warnings, err
+	}
+
+	// Hubs can't fetch feeds that need credentials, and we'd have to give
+	// them the real URL, so private feeds are always polled.
+	if podcast.Private() {
+		return fetch, warnings, nil
+	}
+
+	hub, topic := hubLinks(fetch, podcast.Feed)
+	err = app.updateHub(ctx, podcast, hub, topic)
+	if err != nil {
+		app.errorLog.Printf("subscribing podcast %d to %s: %s", podcast.ID, hub, err)
+	}
+
+	return fetch, warnings, nil
+}
+
+// saveFeed saves a podcast's feed, however we came by it, and returns any
+// problems with its items.
+func (app *application) saveFeed(podcast models.Podcast, fetch feedFetch) ([]string, error) {
+	err := app.saveChannel(podcast.ID, fetch.Feed.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := app.saveEpisodes(podcast.ID, fetch.Feed.Channel.Items, false)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logReport(podcast.ID, report)
+	warnings := report.warnings()
+
+	// Only remember the validators once the episodes have been saved, so
+	// that a failed save is retried in full next time.
+	err = app.podcasts.UpdateValidators(podcast.ID, fetch.ETag, fetch.LastModified, fetch.Hash)
+	if err != nil {
+		return warnings, err
+	}
+
+	// If the publisher has told us the feed is moving, fetch it from the
+	// new URL next time.
+	if newURL, ok := newFeedURL(fetch.Feed.Channel); ok {
+		if newURL = movedURL(podcast, newURL); newURL != podcast.Feed {
+			return warnings, app.moveFeed(podcast, newURL, models.FeedMoveNewFeedURL)
 		}
+	}
+
+	return warnings, nil
+}
 
-		err = app.episodes.Create(ep.Title, ep.GUID, ep.Source.URL, dur, podcastID, pub)
+// logReport logs any problems with the items we've just saved from a
+// podcast's feed.
+func (app *application) logReport(podcastID int, report feedReport) {
+	if len(report.Skipped) == 0 && len(report.Degraded) == 0 {
+		return
+	}
+
+	app.infoLog.Printf("warning: podcast %d: %s", podcastID, report.String())
+	for _, w := range report.warnings() {
+		app.infoLog.Printf("warning: podcast %d: %s", podcastID, w)
+	}
+}
+
+// backfillPodcast refreshes a podcast in the background. Long-running shows
+// can have hundreds of episodes, which is more than we can save within a
+// single request, so any errors are logged rather than returned.
+func (app *application) backfillPodcast(collectionID int) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), app.fetcher.Timeout)
+		defer cancel()
+
+		err := app.refreshAndSchedule(ctx, collectionID)
 		if err != nil {
-			return err
+			app.errorLog.Printf("backfilling podcast %d: %s", collectionID, err)
 		}
+	}()
+}
+
+// backfillPodcasts refreshes several podcasts in the background, through
+// the fetcher so they're spread out across their hosts.
+func (app *application) backfillPodcasts(podcasts []models.Podcast) {
+	if len(podcasts) == 0 {
+		return
 	}
 
-	return nil
+	go func() {
+		for _, result := range app.fetcher.run(context.Background(), podcasts, app.refreshAndSchedule) {
+			if result.Err != nil {
+				app.errorLog.Printf("backfilling podcast %d: %s", result.Podcast.ID, result.Err)
+			}
+		}
+	}()
 }
@@ -1,34 +1,51 @@
 package main
 
 import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
 )
 
-// TestGetEpisodes tests that we can actually fetch episodes.
+// TestGetEpisodes tests that we fetch every episode in a feed, even for
+// long-running shows.
 func TestGetEpisodes(t *testing.T) {
-	app := newTestApplication(t)
-	collectionID := 941907967
+	ts := newTestFeedServer(t, rssFixture(550))
+	defer ts.Close()
 
-	episodes, err := app.getEpisodes(collectionID)
+	fetch, err := newTestFetcher().fetchFeed(context.Background(), models.Podcast{Feed: ts.URL})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(episodes) != 20 {
-		t.Errorf("want %d, got %d episodes", 20, len(episodes))
+	if len(fetch.Feed.Channel.Items) != 550 {
+		t.Errorf("want %d, got %d episodes", 550, len(fetch.Feed.Channel.Items))
 	}
 }
 
 // TestEpisodeSource tests that an episode has a source URL.
 func TestEpisodeSource(t *testing.T) {
-	app := newTestApplication(t)
-	collectionID := 941907967
+	ts := newTestFeedServer(t, rssFixture(1))
+	defer ts.Close()
 
-	episodes, err := app.getEpisodes(collectionID)
+	fetch, err := newTestFetcher().fetchFeed(context.Background(), models.Podcast{Feed: ts.URL})
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	episodes := fetch.Feed.Channel.Items
 	if len(episodes[0].Source.URL) < 1 {
 		t.Errorf("want feedURL to exist, got %q", episodes[0].Source.URL)
 	}
@@ -36,15 +53,15 @@ func TestEpisodeSource(t *testing.T) {
 
 // TestEpisodeLength tests that we can get the length of an individual episode.
 func TestEpisodeLength(t *testing.T) {
-	app := newTestApplication(t)
-	collectionID := 941907967
+	ts := newTestFeedServer(t, rssFixture(1))
+	defer ts.Close()
 
-	episodes, err := app.getEpisodes(collectionID)
+	fetch, err := newTestFetcher().fetchFeed(context.Background(), models.Podcast{Feed: ts.URL})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	duration, err := episodes[0].duration()
+	duration, err := fetch.Feed.Channel.Items[0].duration()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,3 +70,457 @@ func TestEpisodeLength(t *testing.T) {
 		t.Errorf("want duration to be > 1, got %d (rounded)", duration)
 	}
 }
+
+// TestEpisodeUnchanged tests that we only consider an episode changed
+// when one of its stored fields differs from the feed.
+func TestEpisodeUnchanged(t *testing.T) {
+	pub := time.Date(2020, time.June, 1, 9, 0, 0, 0, time.UTC)
+	stored := models.Episode{
+		GUID:        "abc",
+		Title:       "Episode 1",
+		Source:      "https://example.com/1.mp3",
+		Duration:    90,
+		PublishedOn: pub,
+		EpisodeType: "full",
+	}
+
+	tests := []struct {
+		name   string
+		change func(ep *models.Episode)
+		want   bool
+	}{
+		{"Identical", func(ep *models.Episode) {}, true},
+		{"Different zone", func(ep *models.Episode) { ep.PublishedOn = pub.In(time.FixedZone("EDT", -4*60*60)) }, true},
+		{"New title", func(ep *models.Episode) { ep.Title = "Episode 1 (corrected)" }, false},
+		{"New source", func(ep *models.Episode) { ep.Source = "https://example.com/1-v2.mp3" }, false},
+		{"New duration", func(ep *models.Episode) { ep.Duration = 95 }, false},
+		{"New episode type", func(ep *models.Episode) { ep.EpisodeType = "bonus" }, false},
+		{"Now explicit", func(ep *models.Episode) { ep.Explicit = true }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetched := stored
+			tt.change(&fetched)
+
+			got := episodeUnchanged(stored, fetched)
+			if got != tt.want {
+				t.Errorf("want %t, got %t", tt.want, got)
+			}
+		})
+	}
+
+	// An episode that comes back to the feed has changed.
+	removedAt := time.Now()
+	removed := stored
+	removed.RemovedAt = &removedAt
+	if episodeUnchanged(removed, stored) {
+		t.Error("want a returning episode to be changed")
+	}
+}
+
+// TestFeedEpisodeNamespaces tests that we read the iTunes and content
+// namespaces from an item without mixing them up with plain RSS elements.
+func TestFeedEpisodeNamespaces(t *testing.T) {
+	body := `<rss version="2.0"
+		xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"
+		xmlns:content="http://purl.org/rss/1.0/modules/content/">
+		<channel>
+			<item>
+				<title>Plain title</title>
+				<itunes:title>iTunes title</itunes:title>
+				<guid>ep-1</guid>
+				<pubDate>Wed, 03 Jun 2020 11:05:30 +0000</pubDate>
+				<enclosure url="https://example.com/1.mp3" length="12345678" type="audio/mpeg"/>
+				<itunes:duration>1:02:03</itunes:duration>
+				<itunes:episode>12</itunes:episode>
+				<itunes:season>3</itunes:season>
+				<itunes:episodeType>Bonus</itunes:episodeType>
+				<itunes:explicit>yes</itunes:explicit>
+				<itunes:image href="https://example.com/1.jpg"/>
+				<itunes:summary>A short summary.</itunes:summary>
+				<description>A description.</description>
+				<content:encoded><![CDATA[<p>Full notes.</p>]]></content:encoded>
+			</item>
+		</channel>
+	</rss>`
+
+	var feed FeedResults
+	err := xml.Unmarshal([]byte(body), &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := feed.Channel.Items[0]
+	dur, err := item.duration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ep := item.toEpisode(1, dur, time.Now())
+
+	want := models.Episode{
+		PodcastID:       1,
+		GUID:            "ep-1",
+		Title:           "Plain title",
+		Source:          "https://example.com/1.mp3",
+		Duration:        3723,
+		EpisodeNumber:   12,
+		Season:          3,
+		EpisodeType:     "bonus",
+		Explicit:        true,
+		ImageURL:        "https://example.com/1.jpg",
+		Summary:         "A short summary.",
+		Description:     "<p>Full notes.</p>",
+		EnclosureLength: 12345678,
+		EnclosureType:   "audio/mpeg",
+		DurationSource:  models.DurationFromFeed,
+	}
+	want.PublishedOn = ep.PublishedOn
+	want.ItemKey = models.EpisodeKey("ep-1", "", "")
+
+	if ep != want {
+		t.Errorf("want %+v, got %+v", want, ep)
+	}
+}
+
+// TestEpisodeKey tests that episodes are keyed by their GUID where they
+// have one, and by their enclosure and title where they don't.
+func TestEpisodeKey(t *testing.T) {
+	long := strings.Repeat("x", 500)
+
+	withGUID := FeedEpisode{GUID: " " + long + " ", Title: "Episode 1", Source: FeedSource{URL: "https://example.com/1.mp3"}}
+	retitled := FeedEpisode{GUID: long, Title: "Episode 1 (corrected)", Source: FeedSource{URL: "https://example.com/1.mp3"}}
+	if withGUID.key() != retitled.key() {
+		t.Error("want episodes with the same GUID to have the same key")
+	}
+
+	if len(withGUID.key()) != 40 {
+		t.Errorf("want a fixed-length key, got %d characters", len(withGUID.key()))
+	}
+
+	noGUID := FeedEpisode{Title: "Episode 1", Source: FeedSource{URL: "https://example.com/1.mp3"}}
+	if noGUID.key() != (&FeedEpisode{Title: "Episode 1", Source: FeedSource{URL: "https://example.com/1.mp3"}}).key() {
+		t.Error("want the fallback key to be deterministic")
+	}
+
+	otherAudio := FeedEpisode{Title: "Episode 1", Source: FeedSource{URL: "https://example.com/2.mp3"}}
+	if noGUID.key() == otherAudio.key() || noGUID.key() == withGUID.key() {
+		t.Error("want different episodes to have different keys")
+	}
+}
+
+// TestFetchFeedConditional tests that we send the validators from the last
+// fetch and treat a 304 as the feed not having changed.
+func TestFetchFeedConditional(t *testing.T) {
+	body := rssFixture(3)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` && r.Header.Get("If-Modified-Since") == "Mon, 01 Jun 2020 09:00:00 GMT" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 01 Jun 2020 09:00:00 GMT")
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	first, err := newTestFetcher().fetchFeed(context.Background(), models.Podcast{Feed: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.NotModified {
+		t.Fatal("want first fetch to be modified")
+	}
+
+	if first.ETag != `"v1"` || first.Hash == "" {
+		t.Errorf("want validators to be recorded, got %q and %q", first.ETag, first.Hash)
+	}
+
+	second, err := newTestFetcher().fetchFeed(context.Background(), models.Podcast{
+		Feed:         ts.URL,
+		ETag:         first.ETag,
+		LastModified: first.LastModified,
+		FeedHash:     first.Hash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !second.NotModified {
+		t.Error("want second fetch to be not modified")
+	}
+
+	if second.Hash != first.Hash {
+		t.Errorf("want hash %q to be kept, got %q", first.Hash, second.Hash)
+	}
+}
+
+// TestFetchFeedIdenticalHash tests that a feed whose server doesn't support
+// conditional requests is still skipped when its content hasn't changed.
+func TestFetchFeedIdenticalHash(t *testing.T) {
+	ts := newTestFeedServer(t, rssFixture(3))
+	defer ts.Close()
+
+	first, err := newTestFetcher().fetchFeed(context.Background(), models.Podcast{Feed: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := newTestFetcher().fetchFeed(context.Background(), models.Podcast{Feed: ts.URL, FeedHash: first.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !second.NotModified {
+		t.Error("want identical feed to be not modified")
+	}
+
+	if len(second.Feed.Channel.Items) != 0 {
+		t.Errorf("want no episodes to be parsed, got %d", len(second.Feed.Channel.Items))
+	}
+}
+
+// TestFetchFeedCompressed tests that we can read feeds sent with gzip or
+// deflate compression.
+func TestFetchFeedCompressed(t *testing.T) {
+	tests := []struct {
+		encoding string
+		compress func(w io.Writer) io.WriteCloser
+	}{
+		{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+		{"deflate", func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.Contains(r.Header.Get("Accept-Encoding"), tt.encoding) {
+					t.Errorf("want Accept-Encoding to include %s, got %q", tt.encoding, r.Header.Get("Accept-Encoding"))
+				}
+
+				w.Header().Set("Content-Type", "application/rss+xml")
+				w.Header().Set("Content-Encoding", tt.encoding)
+
+				cw := tt.compress(w)
+				cw.Write([]byte(rssFixture(5)))
+				cw.Close()
+			}))
+			defer ts.Close()
+
+			fetch, err := newTestFetcher().fetchFeed(context.Background(), models.Podcast{Feed: ts.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(fetch.Feed.Channel.Items) != 5 {
+				t.Errorf("want %d, got %d episodes", 5, len(fetch.Feed.Channel.Items))
+			}
+		})
+	}
+}
+
+// TestFetchFeedTooLarge tests that we stop reading feeds that go over the
+// maximum size.
+func TestFetchFeedTooLarge(t *testing.T) {
+	ts := newTestFeedServer(t, rssFixture(50))
+	defer ts.Close()
+
+	f := &fetcher{MaxFeedSize: 1024}
+	_, err := f.fetchFeed(context.Background(), models.Podcast{Feed: ts.URL})
+	if !errors.Is(err, ErrFeedTooLarge) {
+		t.Errorf("want %s, got %v", ErrFeedTooLarge, err)
+	}
+}
+
+// TestSaveEpisodesExtras tests that episodes' people and transcripts are
+// saved in batches along with them, and that if they can't be saved,
+// neither are the episodes.
+func TestSaveEpisodesExtras(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+
+	// With no workers, the transcripts aren't fetched in the background.
+	app.fetcher = &fetcher{Timeout: 5 * time.Second}
+
+	podcast, err := app.podcasts.CreateFromFeed("Test Podcast", "https://example.com/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	b.WriteString(`<rss version="2.0" xmlns:podcast="https://podcastindex.org/namespace/1.0"><channel><title>Test Podcast</title>`)
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&b, `<item>
+			<title>Episode %d</title>
+			<guid>ep-%d</guid>
+			<podcast:person role="guest">Guest %d</podcast:person>
+			<podcast:transcript url="https://example.com/%d.txt" type="text/plain"/>
+		</item>`, i, i, i, i)
+	}
+	b.WriteString(`</channel></rss>`)
+
+	feed, err := decodeFeed("application/rss+xml", strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.saveEpisodes(podcast.ID, feed.Channel.Items, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	episodes, err := app.episodes.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []uint
+	titles := map[uint]string{}
+	for _, ep := range episodes {
+		ids = append(ids, ep.ID)
+		titles[ep.ID] = ep.Title
+	}
+
+	people, err := app.people.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(people) != 20 {
+		t.Errorf("want %d people, got %d", 20, len(people))
+	}
+
+	for _, p := range people {
+		if "Guest"+strings.TrimPrefix(titles[p.EpisodeID], "Episode") != p.Name {
+			t.Errorf("want %s listed against its own episode, got %q", p.Name, titles[p.EpisodeID])
+		}
+	}
+
+	transcripts, err := app.transcripts.FindByEpisodeIDs(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transcripts) != 20 {
+		t.Errorf("want %d transcripts, got %d", 20, len(transcripts))
+	}
+
+	// If its extras can't be written, the new episode isn't either.
+	err = app.episodes.DB.DropTable(&models.Chapter{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed.Channel.Items = append(feed.Channel.Items, FeedEpisode{
+		Title: "Episode 21",
+		GUID:  "ep-21",
+	})
+
+	_, err = app.saveEpisodes(podcast.ID, feed.Channel.Items, false)
+	if err == nil {
+		t.Fatal("want an error saving the episode's extras, got none")
+	}
+
+	episodes, err = app.episodes.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(episodes) != 20 {
+		t.Errorf("want %d episodes, got %d", 20, len(episodes))
+	}
+}
+
+// TestSaveEpisodesOversized tests that an item with details too long to
+// store is skipped without stopping the rest of the feed being saved, and
+// that long titles and URLs are kept whole.
+func TestSaveEpisodesOversized(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+
+	podcast, err := app.podcasts.CreateFromFeed("Test Podcast", "https://example.com/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	longTitle := strings.Repeat("A very long title. ", 30)
+
+	body := `<rss version="2.0" xmlns:podcast="https://podcastindex.org/namespace/1.0"><channel>
+		<title>Test Podcast</title>
+		<item>
+			<title>` + longTitle + `</title>
+			<guid>ep-1</guid>
+			<enclosure url="https://example.com/1.mp3?` + strings.Repeat("x", 300) + `" type="audio/mpeg"/>
+		</item>
+		<item>
+			<title>Episode 2</title>
+			<guid>ep-2</guid>
+			<podcast:season name="` + strings.Repeat("S", 256) + `">1</podcast:season>
+			<enclosure url="https://example.com/2.mp3" type="audio/mpeg"/>
+		</item>
+		<item>
+			<title>Episode 3</title>
+			<guid>ep-3</guid>
+			<enclosure url="https://example.com/3.mp3" type="audio/mpeg"/>
+		</item>
+	</channel></rss>`
+
+	feed, err := decodeFeed("application/rss+xml", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := app.saveEpisodes(podcast.ID, feed.Channel.Items, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Skipped) != 1 || report.Skipped[0].Problem != "season name is longer than 255 characters" {
+		t.Errorf("want the second episode skipped for its season name, got %+v", report.Skipped)
+	}
+
+	episodes, err := app.episodes.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(episodes) != 2 {
+		t.Fatalf("want %d episodes, got %d", 2, len(episodes))
+	}
+
+	for _, ep := range episodes {
+		if ep.GUID == "ep-1" && ep.Title != strings.TrimSpace(longTitle) {
+			t.Errorf("want the long title kept whole, got %q", ep.Title)
+		}
+	}
+}
+
+// TestRecordFetchLongError tests that long errors are cut short without
+// splitting a character.
+func TestRecordFetchLongError(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+
+	podcast, err := app.podcasts.CreateFromFeed("Test Podcast", "https://example.com/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.podcasts.RecordFetch(podcast.ID, models.FetchOutcome{
+		At:  time.Now(),
+		Err: errors.New("x" + strings.Repeat("é", 1024)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := app.podcasts.Get(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !utf8.ValidString(saved.LastError) || len(saved.LastError) != 1023 {
+		t.Errorf("want 1023 bytes of whole characters, got %d bytes: %q", len(saved.LastError), saved.LastError)
+	}
+}
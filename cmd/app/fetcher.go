@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// fetcher refreshes lots of podcasts at once. It runs at most Workers
+// refreshes at a time, and since many shows share a host, at most PerHost
+// of those against any one host, starting no more than one request per
+// HostInterval. Each refresh gets Timeout to finish. It also runs jobs in
+// the background, like saving feeds pushed to us by WebSub hubs, at most
+// Workers at a time. Feeds bigger than MaxFeedSize are rejected rather
+// than read into memory.
+type fetcher struct {
+	Workers      int
+	PerHost      int
+	HostInterval time.Duration
+	Timeout      time.Duration
+	MaxFeedSize  int64
+
+	locks    podcastLocks
+	jobsOnce sync.Once
+	jobs     chan struct{}
+}
+
+// maxFeedSize returns the most of a feed we'll read, falling back to
+// defaultMaxFeedSize if MaxFeedSize isn't set.
+func (f *fetcher) maxFeedSize() int64 {
+	if f.MaxFeedSize <= 0 {
+		return defaultMaxFeedSize
+	}
+
+	return f.MaxFeedSize
+}
+
+// fetchResult is the outcome of refreshing a single podcast.
+type fetchResult struct {
+	Podcast models.Podcast
+	Err     error
+}
+
+// hostLimiter spaces out requests to a single host.
+type hostLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until it's our turn to make a request to the host, or the
+// context is done.
+func (l *hostLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	at := time.Now()
+	if l.next.After(at) {
+		at = l.next
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// podcastLocks makes sure only one refresh or push saves a podcast's
+// episodes at a time, since they'd otherwise race to insert the same
+// episodes. The zero value is ready to use.
+type podcastLocks struct {
+	mu    sync.Mutex
+	locks map[int]*podcastLock
+}
+
+// podcastLock is held by whoever has a value in held. refs counts those
+// holding or waiting for it, so it can be dropped once nobody is.
+type podcastLock struct {
+	held chan struct{}
+	refs int
+}
+
+// lock blocks until nothing else is saving the podcast, or the context is
+// done, and returns a func to unlock it again.
+func (l *podcastLocks) lock(ctx context.Context, podcastID int) (func(), error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[int]*podcastLock{}
+	}
+	pl, ok := l.locks[podcastID]
+	if !ok {
+		pl = &podcastLock{held: make(chan struct{}, 1)}
+		l.locks[podcastID] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		pl.refs--
+		if pl.refs == 0 {
+			delete(l.locks, podcastID)
+		}
+		l.mu.Unlock()
+	}
+
+	select {
+	case pl.held <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+
+	return func() {
+		<-pl.held
+		release()
+	}, nil
+}
+
+// feedHost gets the host a podcast's feed is served from, so that feeds
+// on the same host can be limited together.
+func feedHost(feed string) string {
+	u, err := url.Parse(feed)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+// run refreshes each of the podcasts with refresh, and returns how each of
+// them went, in the same order. It doesn't return until every refresh has
+// finished or the context is done.
+func (f *fetcher) run(ctx context.Context, podcasts []models.Podcast, refresh func(context.Context, int) error) []fetchResult {
+	results := make([]fetchResult, len(podcasts))
+
+	// Queue up the podcasts for each host...
+	byHost := map[string][]int{}
+	for i, p := range podcasts {
+		results[i].Podcast = p
+
+		host := feedHost(p.Feed)
+		byHost[host] = append(byHost[host], i)
+	}
+
+	workers := make(chan struct{}, f.Workers)
+	var wg sync.WaitGroup
+
+	// ... and work through each host's queue with up to PerHost goroutines,
+	// each of which takes a worker for as long as it's refreshing.
+	for _, queued := range byHost {
+		queue := make(chan int, len(queued))
+		for _, i := range queued {
+			queue <- i
+		}
+		close(queue)
+
+		limiter := &hostLimiter{interval: f.HostInterval}
+
+		n := f.PerHost
+		if n > len(queued) {
+			n = len(queued)
+		}
+
+		for j := 0; j < n; j++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for i := range queue {
+					results[i].Err = f.refreshOne(ctx, limiter, workers, results[i].Podcast.ID, refresh)
+				}
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// refreshOne waits for its turn at the host and for a free worker, then
+// refreshes a single podcast.
+func (f *fetcher) refreshOne(ctx context.Context, limiter *hostLimiter, workers chan struct{}, podcastID int, refresh func(context.Context, int) error) error {
+	err := limiter.wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case workers <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-workers }()
+
+	ctx, cancel := context.WithTimeout(ctx, f.Timeout)
+	defer cancel()
+
+	return refresh(ctx, podcastID)
+}
+
+// background runs a job in the background, giving it Timeout to finish.
+// Jobs are refused rather than queued once Workers of them are running, so
+// that they can't pile up goroutines.
+func (f *fetcher) background(job func(context.Context)) bool {
+	f.jobsOnce.Do(func() {
+		f.jobs = make(chan struct{}, f.Workers)
+	})
+
+	select {
+	case f.jobs <- struct{}{}:
+	default:
+		return false
+	}
+
+	go func() {
+		defer func() { <-f.jobs }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), f.Timeout)
+		defer cancel()
+
+		job(ctx)
+	}()
+
+	return true
+}
+
+// push saves a feed a hub pushed to us in the background, once nothing
+// else is saving the podcast, giving up if that takes longer than Timeout.
+// Hubs try again later if we're too busy to take it.
+func (f *fetcher) push(podcastID int, save func()) bool {
+	return f.background(func(ctx context.Context) {
+		unlock, err := f.locks.lock(ctx, podcastID)
+		if err != nil {
+			return
+		}
+		defer unlock()
+
+		save()
+	})
+}
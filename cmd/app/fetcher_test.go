@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// TestFetcherLimits tests that the fetcher never runs more refreshes at
+// once than it has workers, or more than it allows against one host.
+func TestFetcherLimits(t *testing.T) {
+	f := &fetcher{Workers: 3, PerHost: 2, Timeout: time.Second}
+
+	var podcasts []models.Podcast
+	for i := 1; i <= 12; i++ {
+		host := []string{"a.example", "b.example", "c.example"}[i%3]
+		podcasts = append(podcasts, models.Podcast{ID: i, Feed: fmt.Sprintf("https://%s/feed/%d", host, i)})
+	}
+
+	hostOf := map[int]string{}
+	for _, p := range podcasts {
+		hostOf[p.ID] = feedHost(p.Feed)
+	}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	perHost, maxPerHost := map[string]int{}, 0
+
+	results := f.run(context.Background(), podcasts, func(ctx context.Context, id int) error {
+		mu.Lock()
+		running++
+		perHost[hostOf[id]]++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		if perHost[hostOf[id]] > maxPerHost {
+			maxPerHost = perHost[hostOf[id]]
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		perHost[hostOf[id]]--
+		mu.Unlock()
+
+		return nil
+	})
+
+	if len(results) != len(podcasts) {
+		t.Fatalf("want %d, got %d results", len(podcasts), len(results))
+	}
+
+	for i, result := range results {
+		if result.Podcast.ID != podcasts[i].ID {
+			t.Errorf("want podcast %d, got %d", podcasts[i].ID, result.Podcast.ID)
+		}
+	}
+
+	if maxRunning > f.Workers {
+		t.Errorf("want at most %d, got %d refreshes at once", f.Workers, maxRunning)
+	}
+
+	if maxPerHost > f.PerHost {
+		t.Errorf("want at most %d, got %d refreshes against one host", f.PerHost, maxPerHost)
+	}
+}
+
+// TestFetcherHostInterval tests that requests to the same host are spaced
+// out.
+func TestFetcherHostInterval(t *testing.T) {
+	f := &fetcher{Workers: 4, PerHost: 4, HostInterval: 20 * time.Millisecond, Timeout: time.Second}
+
+	podcasts := []models.Podcast{
+		{ID: 1, Feed: "https://a.example/1"},
+		{ID: 2, Feed: "https://a.example/2"},
+		{ID: 3, Feed: "https://a.example/3"},
+	}
+
+	start := time.Now()
+	f.run(context.Background(), podcasts, func(ctx context.Context, id int) error {
+		return nil
+	})
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("want at least %s, got %s", 40*time.Millisecond, elapsed)
+	}
+}
+
+// TestFetcherResults tests that errors and timeouts are reported against
+// the podcast they happened to, without stopping the other refreshes.
+func TestFetcherResults(t *testing.T) {
+	f := &fetcher{Workers: 2, PerHost: 2, Timeout: 20 * time.Millisecond}
+
+	podcasts := []models.Podcast{
+		{ID: 1, Feed: "https://a.example/ok"},
+		{ID: 2, Feed: "https://a.example/broken"},
+		{ID: 3, Feed: "https://b.example/slow"},
+	}
+
+	broken := errors.New("broken")
+
+	results := f.run(context.Background(), podcasts, func(ctx context.Context, id int) error {
+		switch id {
+		case 2:
+			return broken
+		case 3:
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	if results[0].Err != nil {
+		t.Errorf("want no error, got %s", results[0].Err)
+	}
+
+	if !errors.Is(results[1].Err, broken) {
+		t.Errorf("want %s, got %v", broken, results[1].Err)
+	}
+
+	if !errors.Is(results[2].Err, context.DeadlineExceeded) {
+		t.Errorf("want %s, got %v", context.DeadlineExceeded, results[2].Err)
+	}
+}
+
+// TestPodcastLocks tests that only one thing at a time can hold a
+// podcast's lock, that other podcasts aren't held up by it, and that
+// waiting for it gives up with the context.
+func TestPodcastLocks(t *testing.T) {
+	var locks podcastLocks
+
+	unlock, err := locks.lock(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlockOther, err := locks.lock(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("want another podcast's lock free, got %s", err)
+	}
+	unlockOther()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = locks.lock(ctx, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %s while it's held, got %v", context.DeadlineExceeded, err)
+	}
+
+	unlock()
+
+	unlock, err = locks.lock(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("want the lock once it's released, got %s", err)
+	}
+	unlock()
+
+	if len(locks.locks) != 0 {
+		t.Errorf("want unused locks dropped, got %d", len(locks.locks))
+	}
+}
+
+// TestFetcherPushes tests that pushes wait for the podcast's lock, and
+// are refused once the fetcher has as many as it can take.
+func TestFetcherPushes(t *testing.T) {
+	f := &fetcher{Workers: 2, PerHost: 2, Timeout: time.Second}
+
+	unlock, err := f.locks.lock(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := make(chan int, 2)
+	for i := 0; i < f.Workers; i++ {
+		if !f.push(1, func() { saved <- 1 }) {
+			t.Fatalf("want push %d queued, got it refused", i+1)
+		}
+	}
+
+	if f.push(2, func() { saved <- 2 }) {
+		t.Error("want a push refused while the fetcher is full, got it queued")
+	}
+
+	select {
+	case id := <-saved:
+		t.Fatalf("want pushes held while podcast %d is being refreshed, got one saved", id)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unlock()
+
+	for i := 0; i < f.Workers; i++ {
+		select {
+		case <-saved:
+		case <-time.After(time.Second):
+			t.Fatal("want the pushes saved once the refresh finished, got nothing")
+		}
+	}
+}
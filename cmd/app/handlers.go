@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/charlesharries/podcast-stats/pkg/forms"
 	"github.com/charlesharries/podcast-stats/pkg/models"
@@ -52,12 +55,18 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 			}
 
 			eps = append(eps, TemplateEpisode{
-				ID:           ep.ID,
-				Title:        ep.Title,
-				PublishedOn:  ep.PublishedOn,
-				Duration:     ep.Duration,
-				Listened:     listened,
-				CollectionID: s.Podcast.ID,
+				ID:            ep.ID,
+				Title:         ep.Title,
+				PublishedOn:   ep.PublishedOn,
+				Duration:      ep.Duration,
+				Listened:      listened,
+				CollectionID:  s.Podcast.ID,
+				EpisodeNumber: ep.EpisodeNumber,
+				Season:        ep.Season,
+				EpisodeType:   ep.EpisodeType,
+				ImageURL:      ep.ImageURL,
+				Notes:         episodeNotes(ep),
+				Removed:       ep.RemovedAt != nil,
 			})
 		}
 
@@ -68,13 +77,21 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 			CollectionID: s.Podcast.ID,
 			Name:         s.Podcast.Name,
 			Episodes:     eps,
+			FailingSince: s.Podcast.FailingSince,
 		})
 	}
 
+	guests, err := app.people.MostListened(currentUser.ID, "guest", 5)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	app.render(w, r, "index.tmpl", &templateData{
 		Subscriptions: ss,
 		Stats:         stats,
 		EpisodesByDay: episodesByDay(ss),
+		Guests:        guests,
 	})
 }
 
@@ -243,6 +260,17 @@ func (app *application) subscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Nobody but its owner can subscribe to a private podcast.
+	podcast, err := app.podcasts.Get(collectionID)
+	if err == nil && !podcast.VisibleTo(currentUser.ID) {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		app.serverError(w, err)
+		return
+	}
+
 	// Check if a user is already subscribed to a podcast.
 	subscription, err := app.subscriptions.Find(collectionID, currentUser.ID)
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -262,21 +290,168 @@ func (app *application) subscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Save the episodes of the newly subscribed podcast.
-	episodes, err := app.getEpisodes(collectionID)
+	// Save the full history of the newly subscribed podcast.
+	app.backfillPodcast(collectionID)
+
+	app.session.Put(r, "flash", fmt.Sprintf("You've been subscribed to %q", form.Get("collectionName")))
+
+	http.Redirect(w, r, "/search?s="+url.QueryEscape(form.Get("search")), http.StatusSeeOther)
+}
+
+// addFeedPage renders the form for subscribing to a podcast by its feed
+// URL.
+func (app *application) addFeedPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "add-feed.tmpl", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+// subscribeFeed subscribes the currently logged in user to a podcast by
+// its feed URL, which lets people follow podcasts that aren't on iTunes.
+func (app *application) subscribeFeed(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("feedURL")
+	if !form.Valid() {
+		app.render(w, r, "add-feed.tmpl", &templateData{Form: form})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), app.fetcher.Timeout)
+	defer cancel()
+
+	currentUser := app.session.Get(r, "authenticatedUser").(TemplateUser)
+	req := newFeedRequest(form)
+
+	podcast, err := app.podcastFromFeed(ctx, currentUser.ID, req)
 	if err != nil {
+		if msg, ok := feedURLProblem(err); ok {
+			app.infoLog.Printf("warning: subscribing to %s: %s", req, err)
+			form.Errors.Add("feedURL", msg)
+			app.render(w, r, "add-feed.tmpl", &templateData{Form: form})
+		} else {
+			app.serverError(w, err)
+		}
+
+		return
+	}
+
+	// Check if a user is already subscribed to a podcast.
+	subscription, err := app.subscriptions.Find(podcast.ID, currentUser.ID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		app.serverError(w, err)
 		return
 	}
 
-	err = app.saveEpisodes(collectionID, episodes)
+	if subscription.PodcastID == podcast.ID {
+		app.session.Put(r, "flash", fmt.Sprintf("Already subscribed to %q", podcast.Name))
+		http.Redirect(w, r, fmt.Sprintf("/podcasts/%d", podcast.ID), http.StatusSeeOther)
+		return
+	}
+
+	err = app.subscriptions.Create(podcast.ID, currentUser.ID)
 	if err != nil {
 		app.serverError(w, err)
+		return
 	}
 
-	app.session.Put(r, "flash", fmt.Sprintf("You've been subscribed to %q", form.Get("collectionName")))
+	// Save the full history of the newly subscribed podcast.
+	app.backfillPodcast(podcast.ID)
 
-	http.Redirect(w, r, "/search?s="+url.QueryEscape(form.Get("search")), http.StatusSeeOther)
+	app.session.Put(r, "flash", fmt.Sprintf("You've been subscribed to %q", podcast.Name))
+
+	http.Redirect(w, r, fmt.Sprintf("/podcasts/%d", podcast.ID), http.StatusSeeOther)
+}
+
+// importPage renders the form for importing subscriptions from an OPML
+// file.
+func (app *application) importPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "import.tmpl", &templateData{
+		Form: forms.New(nil),
+	})
+}
+
+// importSubscriptions subscribes the currently logged in user to every
+// podcast in an uploaded OPML file, and shows them how each one went.
+func (app *application) importSubscriptions(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxOPMLSize)
+
+	err := r.ParseMultipartForm(maxOPMLSize)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+
+	file, _, err := r.FormFile("opml")
+	if err != nil {
+		form.Errors.Add("opml", "Please choose an OPML file to import.")
+		app.render(w, r, "import.tmpl", &templateData{Form: form})
+		return
+	}
+	defer file.Close()
+
+	entries, err := parseOPML(file)
+	if err != nil {
+		app.infoLog.Printf("warning: importing OPML: %s", err)
+		form.Errors.Add("opml", "That doesn't look like an OPML file.")
+		app.render(w, r, "import.tmpl", &templateData{Form: form})
+		return
+	}
+
+	currentUser := app.session.Get(r, "authenticatedUser").(TemplateUser)
+
+	results, err := app.importOPML(r.Context(), currentUser.ID, entries)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.render(w, r, "import.tmpl", &templateData{
+		Form:    form,
+		Imports: results,
+	})
+}
+
+// exportSubscriptions downloads the currently logged in user's
+// subscriptions as an OPML file, for importing into a podcast app. Adding
+// ?group=category puts the podcasts into folders by category.
+func (app *application) exportSubscriptions(w http.ResponseWriter, r *http.Request) {
+	currentUser := app.session.Get(r, "authenticatedUser").(TemplateUser)
+
+	subscriptions, err := app.subscriptions.FindAll(currentUser.ID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	// Private feeds are exported with their real URLs, credentials and all,
+	// since they're the user's own and their podcast app will need them.
+	for i, s := range subscriptions {
+		subscriptions[i].Podcast, err = app.unsealFeed(s.Podcast)
+		if err != nil {
+			app.errorLog.Printf("exporting podcast %d: %s", s.Podcast.ID, err)
+		}
+	}
+
+	doc := subscriptionsOPML(subscriptions, r.URL.Query().Get("group") == "category", time.Now())
+
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="podcast-stats.opml"`)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
 }
 
 // unsubscribe removes a user's podcast subscription.
@@ -318,7 +493,8 @@ func (app *application) unsubscribe(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/search?s="+url.QueryEscape(form.Get("search")), http.StatusSeeOther)
 }
 
-// fetchEpisodes fetches the last 20 episodes of a given podcast and saves them.
+// fetchEpisodes fetches the episodes of a given podcast and saves any new
+// ones, in the background.
 func (app *application) fetchEpisodes(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
@@ -340,24 +516,30 @@ func (app *application) fetchEpisodes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Save the episodes of the newly subscribed podcast.
-	episodes, err := app.getEpisodes(collectionID)
-	if err != nil {
-		app.serverError(w, err)
+	currentUser := app.session.Get(r, "authenticatedUser").(TemplateUser)
+
+	podcast, err := app.podcasts.Get(collectionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !podcast.VisibleTo(currentUser.ID)) {
+		app.clientError(w, http.StatusNotFound)
 		return
 	}
-
-	err = app.saveEpisodes(collectionID, episodes)
 	if err != nil {
 		app.serverError(w, err)
+		return
 	}
 
-	app.session.Put(r, "flash", "Fetched new episodes.")
+	// Save any new or changed episodes in the background, since a big feed
+	// can take longer than we have to answer the request. How it went shows
+	// up in the podcast's feed health.
+	app.backfillPodcast(collectionID)
+
+	app.session.Put(r, "flash", "Fetching new episodes. Any problems will show up under feed health.")
 
 	http.Redirect(w, r, fmt.Sprintf("/podcasts/%d", collectionID), http.StatusSeeOther)
 }
 
-// fetchAllUserEpisodes refetches all of a user's subscriptions
+// fetchAllUserEpisodes refetches all of a user's subscriptions in the
+// background.
 func (app *application) fetchAllUserEpisodes(w http.ResponseWriter, r *http.Request) {
 	currentUser := app.session.Get(r, "authenticatedUser").(TemplateUser)
 
@@ -367,31 +549,16 @@ func (app *application) fetchAllUserEpisodes(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	var wg sync.WaitGroup
-
+	var podcasts []models.Podcast
 	for _, sub := range subscriptions {
-		wg.Add(1)
-
-		go func(sub models.Subscription) {
-			// Save the episodes of the newly subscribed podcast.
-			episodes, err := app.getEpisodes(sub.PodcastID)
-			if err != nil {
-				app.serverError(w, err)
-				return
-			}
-
-			err = app.saveEpisodes(sub.PodcastID, episodes)
-			if err != nil {
-				app.serverError(w, err)
-			}
-
-			wg.Done()
-		}(sub)
+		podcasts = append(podcasts, sub.Podcast)
 	}
 
-	wg.Wait()
+	// Save any new or changed episodes in the background, through the
+	// fetcher. How each podcast went shows up in its feed health.
+	app.backfillPodcasts(podcasts)
 
-	app.session.Put(r, "flash", "Fetched new episodes.")
+	app.session.Put(r, "flash", "Fetching new episodes. Any problems will show up under each podcast's feed health.")
 
 	http.Redirect(w, r, fmt.Sprintf("/"), http.StatusSeeOther)
 }
@@ -409,6 +576,10 @@ func (app *application) podcastPage(w http.ResponseWriter, r *http.Request) {
 	podcast, err := app.podcasts.Find(collectionID)
 
 	currentUser := app.session.Get(r, "authenticatedUser").(TemplateUser)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !podcast.VisibleTo(currentUser.ID)) {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		app.serverError(w, err)
 		return
@@ -425,6 +596,37 @@ func (app *application) podcastPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chapters, err := app.chapters.FindByEpisodeIDs(episodeIDs)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	transcripts, err := app.transcripts.FindByEpisodeIDs(episodeIDs)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	chaptersByEpisode := map[uint][]models.Chapter{}
+	for _, c := range chapters {
+		chaptersByEpisode[c.EpisodeID] = append(chaptersByEpisode[c.EpisodeID], c)
+	}
+
+	// Show the first transcript we've managed to download for each episode.
+	transcriptByEpisode := map[uint]string{}
+	for _, t := range transcripts {
+		if _, ok := transcriptByEpisode[t.EpisodeID]; !ok && t.Text != "" {
+			transcriptByEpisode[t.EpisodeID] = t.Text
+		}
+	}
+
+	revisions, err := app.episodes.RevisionCounts(collectionID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	var episodes []TemplateEpisode
 	for _, ep := range podcast.Episodes {
 		listened := false
@@ -437,18 +639,201 @@ func (app *application) podcastPage(w http.ResponseWriter, r *http.Request) {
 		}
 
 		episodes = append(episodes, TemplateEpisode{
-			ID:          ep.ID,
-			Title:       ep.Title,
-			Duration:    ep.Duration,
-			PublishedOn: ep.PublishedOn,
-			Listened:    listened,
+			ID:            ep.ID,
+			Title:         ep.Title,
+			Duration:      ep.Duration,
+			PublishedOn:   ep.PublishedOn,
+			Listened:      listened,
+			EpisodeNumber: ep.EpisodeNumber,
+			Season:        ep.Season,
+			EpisodeType:   ep.EpisodeType,
+			ImageURL:      ep.ImageURL,
+			Notes:         episodeNotes(ep),
+			Chapters:      chaptersByEpisode[ep.ID],
+			Transcript:    transcriptByEpisode[ep.ID],
+			Removed:       ep.RemovedAt != nil,
+			Revisions:     revisions[ep.ID],
 		})
 	}
 
+	moves, err := app.podcasts.FeedMoves(collectionID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	merges, err := app.episodes.Merges(collectionID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	app.render(w, r, "podcast.tmpl", &templateData{
-		Podcast:  podcast,
-		Episodes: episodes,
+		Podcast:       podcast,
+		Episodes:      episodes,
+		EpisodeMerges: merges,
+		FeedMoves:     moves,
+	})
+}
+
+// episodeHistory renders the history of changes to an episode's details
+// in its feed.
+func (app *application) episodeHistory(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get(":id")
+
+	episodeID, err := strconv.Atoi(id)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	episode, err := app.episodes.Get(uint(episodeID))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	podcast, err := app.podcasts.Get(episode.PodcastID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	currentUser := app.session.Get(r, "authenticatedUser").(TemplateUser)
+	if !podcast.VisibleTo(currentUser.ID) {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+
+	revisions, err := app.episodes.Revisions(episode.ID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.render(w, r, "episode-history.tmpl", &templateData{
+		Podcast:   podcast,
+		Episode:   episode,
+		Revisions: groupRevisions(revisions),
+	})
+}
+
+// websubVerify answers a WebSub hub checking that we really asked to
+// subscribe to, or unsubscribe from, a podcast's feed, or telling us that
+// it's refused.
+func (app *application) websubVerify(w http.ResponseWriter, r *http.Request) {
+	collectionID, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+
+	podcast, err := app.podcasts.Get(collectionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+
+	if q.Get("hub.mode") == "denied" {
+		if podcast.HubURL != "" && q.Get("hub.topic") == podcast.HubTopic {
+			app.infoLog.Printf("warning: hub %s refused podcast %d: %s", podcast.HubURL, podcast.ID, q.Get("hub.reason"))
+
+			err = app.podcasts.ClearHub(podcast.ID)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	now := time.Now()
+
+	challenge, lease, ok := verifyIntent(podcast, q, now)
+	if !ok {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+
+	if lease > 0 {
+		err = app.podcasts.ConfirmHub(podcast.ID, now.Add(lease))
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		app.infoLog.Printf("hub %s is pushing podcast %d for %s", podcast.HubURL, podcast.ID, lease)
+	}
+
+	w.Write([]byte(challenge))
+}
+
+// websubNotify receives a podcast's feed pushed from its WebSub hub, and
+// saves it if it's signed with the secret we gave the hub. Hubs only need
+// to know we got it, so anything unsigned is acknowledged and ignored, and
+// the feed is saved in the background through the fetcher. If it already
+// has as many pushes as it can take, we ask the hub to try again later.
+func (app *application) websubNotify(w http.ResponseWriter, r *http.Request) {
+	collectionID, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+
+	podcast, err := app.podcasts.Get(collectionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.clientError(w, http.StatusGone)
+		return
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if podcast.HubURL == "" {
+		app.clientError(w, http.StatusGone)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, app.fetcher.maxFeedSize()))
+	if err != nil {
+		app.clientError(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !validSignature(podcast.HubSecret, r.Header.Get("X-Hub-Signature"), body) {
+		app.infoLog.Printf("warning: ignoring push for podcast %d with a bad signature", podcast.ID)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	queued := app.fetcher.push(podcast.ID, func() {
+		err := app.ingestPush(podcast, contentType, body)
+		if err != nil {
+			app.errorLog.Printf("saving push for podcast %d: %s", podcast.ID, err)
+		}
 	})
+	if !queued {
+		app.infoLog.Printf("warning: too busy to save push for podcast %d", podcast.ID)
+		w.Header().Set("Retry-After", "60")
+		app.clientError(w, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
 }
 
 // listen creates a new episode listen for the logged-in user.
@@ -40,6 +40,23 @@ func (app *application) apiServerError(w http.ResponseWriter, err error) {
 	http.Error(w, string(js), http.StatusInternalServerError)
 }
 
+// apiClientError writes an error with whatever status code and message
+// we pass in to a JSON response.
+func (app *application) apiClientError(w http.ResponseWriter, status int, message string) {
+	body := map[string]interface{}{
+		"error":   true,
+		"message": message,
+	}
+	js, err := json.Marshal(body)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	http.Error(w, string(js), status)
+}
+
 // clientError writes an error with whatever status code we pass in.
 func (app *application) clientError(w http.ResponseWriter, status int) {
 	http.Error(w, http.StatusText(status), status)
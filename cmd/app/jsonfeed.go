@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// JSONFeed is a full JSON Feed (https://jsonfeed.org) document.
+type JSONFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	Description string           `json:"description"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Icon        string           `json:"icon"`
+	Language    string           `json:"language"`
+	Author      *JSONFeedAuthor  `json:"author"`
+	Authors     []JSONFeedAuthor `json:"authors"`
+	Items       []JSONFeedItem   `json:"items"`
+}
+
+// JSONFeedAuthor is the author of a JSON Feed. Version 1.1 feeds list
+// authors, while 1.0 feeds have a single one.
+type JSONFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// JSONFeedItem is a single item in a JSON Feed.
+type JSONFeedItem struct {
+	ID            jsonFeedID           `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html"`
+	ContentText   string               `json:"content_text"`
+	Summary       string               `json:"summary"`
+	Image         string               `json:"image"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Attachments   []JSONFeedAttachment `json:"attachments"`
+}
+
+// JSONFeedAttachment is a file attached to a JSON Feed item. For podcasts,
+// this is the episode audio.
+type JSONFeedAttachment struct {
+	URL               string  `json:"url"`
+	MimeType          string  `json:"mime_type"`
+	Title             string  `json:"title"`
+	SizeInBytes       int64   `json:"size_in_bytes"`
+	DurationInSeconds float64 `json:"duration_in_seconds"`
+}
+
+// jsonFeedID is an item ID. The spec says IDs are strings, but plenty of
+// feeds use numbers, so we accept either.
+type jsonFeedID string
+
+// UnmarshalJSON reads a string or numeric ID.
+func (id *jsonFeedID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = jsonFeedID(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+
+	*id = jsonFeedID(n.String())
+
+	return nil
+}
+
+// audio finds the item's audio attachment, falling back to the first
+// attachment of any kind.
+func (item *JSONFeedItem) audio() JSONFeedAttachment {
+	for _, a := range item.Attachments {
+		if strings.HasPrefix(a.MimeType, "audio/") {
+			return a
+		}
+	}
+
+	if len(item.Attachments) > 0 {
+		return item.Attachments[0]
+	}
+
+	return JSONFeedAttachment{}
+}
+
+// toFeedEpisode normalizes a JSON Feed item into the same shape as an RSS
+// item, so it can be saved the same way.
+func (item *JSONFeedItem) toFeedEpisode() FeedEpisode {
+	published := item.DatePublished
+	if strings.TrimSpace(published) == "" {
+		published = item.DateModified
+	}
+
+	audio := item.audio()
+
+	var duration, length string
+	if audio.DurationInSeconds > 0 {
+		duration = strconv.Itoa(int(audio.DurationInSeconds + 0.5))
+	}
+	if audio.SizeInBytes > 0 {
+		length = strconv.FormatInt(audio.SizeInBytes, 10)
+	}
+
+	description := item.ContentHTML
+	if strings.TrimSpace(description) == "" {
+		description = item.ContentText
+	}
+
+	return FeedEpisode{
+		Title:       item.Title,
+		GUID:        string(item.ID),
+		PublishedOn: published,
+		Source: FeedSource{
+			URL:    audio.URL,
+			Length: length,
+			Type:   audio.MimeType,
+		},
+		Duration:       duration,
+		Image:          FeedImage{Href: item.Image},
+		Summary:        item.Summary,
+		ContentEncoded: description,
+	}
+}
+
+// toFeedResults normalizes a JSON Feed into the same shape as an RSS feed.
+func (f *JSONFeed) toFeedResults() FeedResults {
+	var items []FeedEpisode
+	for _, item := range f.Items {
+		items = append(items, item.toFeedEpisode())
+	}
+
+	channel := FeedChannel{
+		Title:       f.Title,
+		Description: f.Description,
+		Link:        f.HomePageURL,
+		Language:    f.Language,
+		Image:       FeedChannelImage{URL: f.Icon},
+		Items:       items,
+	}
+
+	if len(f.Authors) > 0 {
+		channel.Author = f.Authors[0].Name
+	} else if f.Author != nil {
+		channel.Author = f.Author.Name
+	}
+
+	return FeedResults{Channel: channel}
+}
+
+// isJSONFeed checks whether a feed is JSON rather than XML, going by its
+// content type or, failing that, by what the body looks like.
+func isJSONFeed(contentType string, body []byte) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/feed+json", "application/json":
+		return true
+	}
+
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	body = bytes.TrimLeft(body, " \t\r\n")
+
+	return len(body) > 0 && body[0] == '{'
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseFeedJSON tests that a JSON Feed is detected, either by its
+// content type or by sniffing the body, and its items normalized into
+// episodes.
+func TestParseFeedJSON(t *testing.T) {
+	body := `{
+		"version": "https://jsonfeed.org/version/1.1",
+		"title": "JSON Podcast",
+		"items": [
+			{
+				"id": "ep-2",
+				"title": "Second episode",
+				"content_html": "<p>Notes</p>",
+				"date_published": "2020-06-10T09:00:00-07:00",
+				"attachments": [
+					{"url": "https://example.com/2.txt", "mime_type": "text/plain"},
+					{"url": "https://example.com/2.m4a", "mime_type": "audio/x-m4a", "size_in_bytes": 4321, "duration_in_seconds": 1800.6}
+				]
+			},
+			{
+				"id": 1,
+				"title": "First episode",
+				"date_published": "2020-06-03T11:05:30Z",
+				"attachments": [{"url": "https://example.com/1.mp3", "mime_type": "audio/mpeg"}]
+			}
+		]
+	}`
+
+	for _, contentType := range []string{"application/feed+json; charset=utf-8", "text/plain"} {
+		feed, err := decodeFeed(contentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(feed.Channel.Items) != 2 {
+			t.Fatalf("want %d, got %d episodes", 2, len(feed.Channel.Items))
+		}
+
+		second := feed.Channel.Items[0]
+		if second.Source.URL != "https://example.com/2.m4a" || second.Source.Length != "4321" {
+			t.Errorf("want audio attachment, got %+v", second.Source)
+		}
+
+		if dur, _ := second.duration(); dur != 1801 {
+			t.Errorf("want duration %d, got %d", 1801, dur)
+		}
+
+		if second.description() != "<p>Notes</p>" {
+			t.Errorf("want content_html as description, got %q", second.description())
+		}
+
+		if feed.Channel.Items[1].GUID != "1" {
+			t.Errorf("want numeric ID to be read as %q, got %q", "1", feed.Channel.Items[1].GUID)
+		}
+	}
+}
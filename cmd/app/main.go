@@ -2,11 +2,13 @@ package main
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/charlesharries/podcast-stats/pkg/models"
@@ -19,15 +21,21 @@ import (
 
 type application struct {
 	cache         *mysqlcache.Model
+	chapters      *models.ChapterModel
 	errorLog      *log.Logger
 	infoLog       *log.Logger
 	episodes      *models.EpisodeModel
+	feeds         *feedSealer
+	fetcher       *fetcher
 	listens       *models.ListenModel
+	people        *models.PersonModel
 	podcasts      *models.PodcastModel
 	session       *sessions.Session
 	subscriptions *models.SubscriptionModel
 	templateCache map[string]*template.Template
+	transcripts   *models.TranscriptModel
 	users         *models.UserModel
+	websub        *websub
 }
 
 func main() {
@@ -62,17 +70,74 @@ func main() {
 	// Assemble our application struct
 	app := &application{
 		cache:         &mysqlcache.Model{DB: db, Expiry: 24 * time.Hour},
+		chapters:      &models.ChapterModel{DB: db},
 		errorLog:      errorLog,
 		infoLog:       infoLog,
 		episodes:      &models.EpisodeModel{DB: db},
+		fetcher:       &fetcher{Workers: 8, PerHost: 2, HostInterval: 500 * time.Millisecond, Timeout: 30 * time.Second},
 		listens:       &models.ListenModel{DB: db},
+		people:        &models.PersonModel{DB: db},
 		podcasts:      &models.PodcastModel{DB: db},
 		session:       session,
 		subscriptions: &models.SubscriptionModel{DB: db},
 		templateCache: templateCache,
+		transcripts:   &models.TranscriptModel{DB: db},
 		users:         &models.UserModel{DB: db},
 	}
 
+	// Feeds bigger than this are rejected rather than read into memory.
+	if v := os.Getenv("MAX_FEED_SIZE"); v != "" {
+		app.fetcher.MaxFeedSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	// Refresh feeds in the background. Set SCHEDULER_INTERVAL to 0 to turn
+	// this off.
+	interval := time.Minute
+	if v := os.Getenv("SCHEDULER_INTERVAL"); v != "" {
+		interval, err = time.ParseDuration(v)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+	if interval > 0 {
+		go app.runScheduler(interval)
+	}
+
+	// Have feeds that advertise a WebSub hub pushed to us. This is off
+	// unless WEBSUB_CALLBACK_URL is set to the app's public address, since
+	// hubs need to be able to reach us.
+	if v := os.Getenv("WEBSUB_CALLBACK_URL"); v != "" {
+		app.websub = &websub{CallbackURL: v, Lease: 7 * 24 * time.Hour, RenewBefore: 24 * time.Hour, Timeout: 30 * time.Second}
+	}
+
+	// Encrypt private feeds with FEED_ENCRYPTION_KEY, or failing that a key
+	// derived from APP_SECRET.
+	key, err := feedKey(os.Getenv("FEED_ENCRYPTION_KEY"), os.Getenv("APP_SECRET"))
+	if err != nil && !errors.Is(err, ErrPrivateFeedsOff) {
+		errorLog.Fatal(err)
+	}
+	if err == nil {
+		app.feeds, err = newFeedSealer(key)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	// Probe the durations of episodes whose feeds don't give one. This is
+	// off unless DURATION_PROBE_INTERVAL is set.
+	if v := os.Getenv("DURATION_PROBE_INTERVAL"); v != "" {
+		probeInterval, err := time.ParseDuration(v)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		if probeInterval > 0 {
+			go app.runProber(probeInterval)
+		}
+	}
+
 	// Create a custom server.
 	srv := &http.Server{
 		Addr:         os.Getenv("APP_HOST") + ":" + os.Getenv("PORT"),
@@ -108,14 +173,35 @@ func openDB() (*gorm.DB, error) {
 		return nil, err
 	}
 
+	err = models.LinkITunesIDs(db)
+	if err != nil {
+		return nil, err
+	}
+
 	db.AutoMigrate(
+		&models.Chapter{},
 		&models.Episode{},
+		&models.EpisodeMerge{},
+		&models.EpisodeRevision{},
+		&models.FeedMove{},
 		&models.Listen{},
+		&models.Person{},
 		&models.Podcast{},
 		&models.Subscription{},
+		&models.Transcript{},
 		&models.User{},
 		&mysqlcache.CacheEntry{},
 	)
 
+	err = models.RepairEpisodeIdentity(db)
+	if err != nil {
+		return nil, err
+	}
+
+	err = models.WidenEpisodeColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
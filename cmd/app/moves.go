@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// followPermanent builds a redirect policy for feed requests which follows
+// redirects as normal, but records where the feed ended up if every hop
+// along the way was permanent. Once a temporary redirect is seen, movedTo
+// is left alone, since the feed hasn't really moved.
+func followPermanent(movedTo *string) func(*http.Request, []*http.Request) error {
+	permanent := true
+
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		if !permanent || req.Response == nil {
+			return nil
+		}
+
+		switch req.Response.StatusCode {
+		case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+			*movedTo = req.URL.String()
+		default:
+			permanent = false
+		}
+
+		return nil
+	}
+}
+
+// newFeedURL gets the itunes:new-feed-url from a channel, if it has a
+// usable one.
+func newFeedURL(channel FeedChannel) (string, bool) {
+	raw := strings.TrimSpace(channel.NewFeedURL)
+	if raw == "" {
+		return "", false
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+
+	return u.String(), true
+}
+
+// movedURL gets the URL a podcast's feed has moved to. Private feeds keep
+// their credentials when they move within the same host.
+func movedURL(podcast models.Podcast, newURL string) string {
+	if !podcast.Private() || newURL == "" {
+		return newURL
+	}
+
+	return keepCredentials(podcast.Feed, newURL)
+}
+
+// moveFeed points a podcast at its new feed URL and records the move.
+// Private podcasts have their new URL sealed, and only its label recorded.
+func (app *application) moveFeed(podcast models.Podcast, newURL, reason string) error {
+	if !podcast.Private() {
+		app.infoLog.Printf("podcast %d moved from %s to %s (%s)", podcast.ID, podcast.Feed, newURL, reason)
+
+		return app.podcasts.MoveFeed(podcast.ID, podcast.Feed, newURL, reason)
+	}
+
+	oldLabel, newLabel := feedLabel(podcast.Feed), feedLabel(newURL)
+	app.infoLog.Printf("private podcast %d moved from %s to %s (%s)", podcast.ID, oldLabel, newLabel, reason)
+
+	secret, err := app.feeds.seal(*podcast.OwnerID, newURL)
+	if err != nil {
+		return err
+	}
+
+	return app.podcasts.MovePrivateFeed(podcast.ID, oldLabel, newLabel, secret, reason)
+}
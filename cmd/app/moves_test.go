@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// TestFetchFeedPermanentRedirect tests that we notice when a feed has
+// permanently moved, but not when it's only temporarily elsewhere.
+func TestFetchFeedPermanentRedirect(t *testing.T) {
+	body := rssFixture(1)
+
+	mux := http.NewServeMux()
+	mux.Handle("/moved", http.RedirectHandler("/new", http.StatusMovedPermanently))
+	mux.Handle("/moved-308", http.RedirectHandler("/new", http.StatusPermanentRedirect))
+	mux.Handle("/temporary", http.RedirectHandler("/new", http.StatusFound))
+	mux.Handle("/moved-then-temporary", http.RedirectHandler("/temporary", http.StatusMovedPermanently))
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/new", ""},
+		{"/moved", ts.URL + "/new"},
+		{"/moved-308", ts.URL + "/new"},
+		{"/temporary", ""},
+		{"/moved-then-temporary", ts.URL + "/temporary"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			fetch, err := newTestFetcher().fetchFeed(context.Background(), models.Podcast{Feed: ts.URL + tt.path})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fetch.MovedTo != tt.want {
+				t.Errorf("want moved to %q, got %q", tt.want, fetch.MovedTo)
+			}
+
+			if len(fetch.Feed.Channel.Items) != 1 {
+				t.Errorf("want the feed to be fetched from its new home")
+			}
+		})
+	}
+}
+
+// TestNewFeedURL tests that we only accept a usable itunes:new-feed-url.
+func TestNewFeedURL(t *testing.T) {
+	body := `<rss xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel>
+		<itunes:new-feed-url> https://feeds.example.com/show </itunes:new-feed-url>
+	</channel></rss>`
+
+	feed, err := decodeFeed("application/rss+xml", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := newFeedURL(feed.Channel)
+	if !ok || got != "https://feeds.example.com/show" {
+		t.Errorf("want new feed URL, got %q", got)
+	}
+
+	for _, bad := range []string{"", "not a url", "/relative", "ftp://example.com/feed"} {
+		if _, ok := newFeedURL(FeedChannel{NewFeedURL: bad}); ok {
+			t.Errorf("want %q to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+	"github.com/jinzhu/gorm"
+)
+
+// maxOPMLSize is the biggest OPML upload we'll accept, along with the
+// rest of the request it comes in.
+const maxOPMLSize = 5 << 20
+
+// ErrNotOPML is returned when an upload isn't an OPML document.
+var ErrNotOPML = errors.New("not an OPML document")
+
+// OPML is an OPML 1.0 or 2.0 document, which is how podcast apps import
+// and export their subscriptions.
+type OPML struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    OPMLHead `xml:"head"`
+	Body    OPMLBody `xml:"body"`
+}
+
+// OPMLHead holds the details of an OPML document.
+type OPMLHead struct {
+	Title       string `xml:"title"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+// OPMLBody holds an OPML document's outlines.
+type OPMLBody struct {
+	Outlines []OPMLOutline `xml:"outline"`
+}
+
+// OPMLOutline is a single outline in an OPML document. Podcasts are
+// outlines with an xmlUrl, and apps which sort them into folders nest them
+// inside outlines without one.
+type OPMLOutline struct {
+	Type     string        `xml:"type,attr,omitempty"`
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string        `xml:"htmlUrl,attr,omitempty"`
+	Category string        `xml:"category,attr,omitempty"`
+	Outlines []OPMLOutline `xml:"outline"`
+}
+
+// UnmarshalXML reads an outline. Not every app gets the case of the
+// attribute names right, so they're matched without it.
+func (o *OPMLOutline) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		switch strings.ToLower(attr.Name.Local) {
+		case "type":
+			o.Type = attr.Value
+		case "text":
+			o.Text = attr.Value
+		case "title":
+			o.Title = attr.Value
+		case "xmlurl":
+			o.XMLURL = attr.Value
+		case "htmlurl":
+			o.HTMLURL = attr.Value
+		case "category":
+			o.Category = attr.Value
+		}
+	}
+
+	var children struct {
+		Outlines []OPMLOutline `xml:"outline"`
+	}
+
+	err := d.DecodeElement(&children, &start)
+	o.Outlines = children.Outlines
+
+	return err
+}
+
+// opmlEntry is a single feed listed in an OPML document.
+type opmlEntry struct {
+	Title string
+	URL   string
+}
+
+// parseOPML reads the feeds out of an OPML document, including any inside
+// folders. Feeds listed more than once are only returned the first time.
+func parseOPML(r io.Reader) ([]opmlEntry, error) {
+	var doc OPML
+
+	d := xml.NewDecoder(&limitedReader{r: r, n: maxOPMLSize})
+	d.CharsetReader = charsetReader
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+
+	root, err := rootElement(d)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotOPML, err)
+	}
+
+	if root.Name.Local != "opml" {
+		return nil, fmt.Errorf("%w: <%s>", ErrNotOPML, root.Name.Local)
+	}
+
+	err = d.DecodeElement(&doc, &root)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotOPML, err)
+	}
+
+	var entries []opmlEntry
+	seen := map[string]bool{}
+
+	var walk func(outlines []OPMLOutline)
+	walk = func(outlines []OPMLOutline) {
+		for _, o := range outlines {
+			url := strings.TrimSpace(o.XMLURL)
+			if url != "" && !seen[url] {
+				seen[url] = true
+				entries = append(entries, opmlEntry{
+					Title: firstNonEmpty(o.Title, o.Text),
+					URL:   url,
+				})
+			}
+
+			walk(o.Outlines)
+		}
+	}
+	walk(doc.Body.Outlines)
+
+	return entries, nil
+}
+
+// opmlCategories converts a podcast's categories into the slash-separated
+// paths OPML uses, like "/Technology/Podcasting".
+func opmlCategories(categories string) string {
+	var paths []string
+
+	for _, cat := range strings.Split(categories, ",") {
+		var parts []string
+		for _, part := range strings.Split(cat, ">") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, strings.ReplaceAll(part, "/", "-"))
+			}
+		}
+
+		if len(parts) > 0 {
+			paths = append(paths, "/"+strings.Join(parts, "/"))
+		}
+	}
+
+	return strings.Join(paths, ",")
+}
+
+// topCategory gets the first top-level category a podcast is in.
+func topCategory(categories string) string {
+	first := strings.SplitN(categories, ",", 2)[0]
+
+	return strings.TrimSpace(strings.SplitN(first, ">", 2)[0])
+}
+
+// subscriptionsOPML builds an OPML document listing the podcasts a user is
+// subscribed to, in alphabetical order. If byCategory is set, podcasts are
+// put in a folder for their first category, and any without one are left
+// at the top.
+func subscriptionsOPML(subscriptions []models.Subscription, byCategory bool, now time.Time) OPML {
+	var outlines []OPMLOutline
+	folders := map[string]*OPMLOutline{}
+
+	sort.SliceStable(subscriptions, func(i, j int) bool {
+		return strings.ToLower(subscriptions[i].Podcast.Name) < strings.ToLower(subscriptions[j].Podcast.Name)
+	})
+
+	for _, s := range subscriptions {
+		name := firstNonEmpty(s.Podcast.Name, s.Podcast.Title, s.Podcast.Feed)
+		outline := OPMLOutline{
+			Type:     "rss",
+			Text:     name,
+			Title:    name,
+			XMLURL:   s.Podcast.Feed,
+			HTMLURL:  s.Podcast.Link,
+			Category: opmlCategories(s.Podcast.Categories),
+		}
+
+		category := topCategory(s.Podcast.Categories)
+		if !byCategory || category == "" {
+			outlines = append(outlines, outline)
+			continue
+		}
+
+		folder, ok := folders[category]
+		if !ok {
+			folder = &OPMLOutline{Text: category}
+			folders[category] = folder
+		}
+		folder.Outlines = append(folder.Outlines, outline)
+	}
+
+	var names []string
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var grouped []OPMLOutline
+	for _, name := range names {
+		grouped = append(grouped, *folders[name])
+	}
+
+	return OPML{
+		Version: "2.0",
+		Head: OPMLHead{
+			Title:       "Podcast Stats subscriptions",
+			DateCreated: now.UTC().Format(time.RFC1123Z),
+		},
+		Body: OPMLBody{Outlines: append(grouped, outlines...)},
+	}
+}
+
+// What happened to each feed in an import.
+const (
+	importAdded             = "added"
+	importAlreadySubscribed = "already-subscribed"
+	importUnreachable       = "unreachable"
+	importInvalid           = "invalid"
+)
+
+// importResult is what happened to a single feed from an OPML import.
+type importResult struct {
+	Title     string `json:"title"`
+	URL       string `json:"url"`
+	PodcastID int    `json:"podcastID,omitempty"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+
+	podcast models.Podcast
+}
+
+// importLabels describes each import status for people.
+var importLabels = map[string]string{
+	importAdded:             "Added",
+	importAlreadySubscribed: "Already subscribed",
+	importUnreachable:       "Feed unreachable",
+	importInvalid:           "Not a podcast feed",
+}
+
+// Label describes what happened to the feed.
+func (r importResult) Label() string {
+	return importLabels[r.Status]
+}
+
+// fail records why we couldn't subscribe to a feed.
+func (r *importResult) fail(err error) {
+	msg, ok := feedURLProblem(err)
+	if !ok {
+		msg = "We couldn't fetch that feed. Check the URL and try again."
+	}
+
+	r.Status = importUnreachable
+	if errors.Is(err, ErrInvalidFeedURL) || errors.Is(err, ErrNotAFeed) {
+		r.Status = importInvalid
+	}
+
+	r.Message = msg
+}
+
+// importSummary describes how an import went.
+func importSummary(results []importResult) string {
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+	}
+
+	noun := "podcasts"
+	if counts[importAdded] == 1 {
+		noun = "podcast"
+	}
+
+	parts := []string{fmt.Sprintf("Subscribed to %d new %s", counts[importAdded], noun)}
+
+	if n := counts[importAlreadySubscribed]; n > 0 {
+		parts = append(parts, fmt.Sprintf("%d already subscribed", n))
+	}
+
+	if n := counts[importUnreachable] + counts[importInvalid]; n > 0 {
+		parts = append(parts, fmt.Sprintf("%d couldn't be added", n))
+	}
+
+	return strings.Join(parts, ", ") + "."
+}
+
+// importOPML subscribes a user to each of the feeds from an OPML document
+// and reports what happened to each one. Feeds we already have are
+// matched by URL. The rest are fetched to check they work before they're
+// saved, through the fetcher so we don't hammer any one host, and are
+// named after the feed rather than the document. Feeds with credentials
+// in their URLs become the user's own private podcasts. Everything the
+// user wasn't already subscribed to is backfilled in the background.
+func (app *application) importOPML(ctx context.Context, userID uint, entries []opmlEntry) ([]importResult, error) {
+	results := make([]importResult, len(entries))
+	feedURLs := make([]string, len(entries))
+	private := make([]bool, len(entries))
+
+	// Match up the feeds we already have, keeping track of the ones we
+	// don't. The fetcher works on podcasts, so each new feed goes in as a
+	// podcast whose ID is its place in the results. A feed listed more
+	// than once is only checked the first time.
+	var unknown []models.Podcast
+	first := map[string]int{}
+	for i, e := range entries {
+		results[i] = importResult{Title: e.Title, URL: e.URL}
+
+		feedURL, err := normalizeFeedURL(e.URL)
+		if err != nil {
+			results[i].fail(err)
+			continue
+		}
+
+		feedURLs[i] = feedURL
+		if _, ok := first[feedURL]; ok {
+			continue
+		}
+		first[feedURL] = i
+
+		if hasCredentials(feedURL) {
+			private[i] = true
+			unknown = append(unknown, models.Podcast{ID: i, Feed: feedLabel(feedURL)})
+			continue
+		}
+
+		podcast, err := app.podcasts.FindByFeed(feedURL)
+		if err == nil {
+			results[i].podcast = podcast
+			continue
+		}
+		if !gorm.IsRecordNotFoundError(err) {
+			return nil, err
+		}
+
+		unknown = append(unknown, models.Podcast{ID: i, Feed: feedURL})
+	}
+
+	// Check and save the new feeds...
+	create := func(ctx context.Context, i int) error {
+		if private[i] {
+			var err error
+			results[i].podcast, err = app.privatePodcast(ctx, userID, feedURLs[i])
+
+			return err
+		}
+
+		name, feedURL, err := app.fetcher.checkFeed(ctx, feedURLs[i])
+		if err != nil {
+			return err
+		}
+
+		results[i].podcast, err = app.podcasts.CreateFromFeed(name, feedURL)
+
+		return err
+	}
+
+	for _, fr := range app.fetcher.run(ctx, unknown, create) {
+		if fr.Err != nil {
+			if _, ok := feedURLProblem(fr.Err); !ok {
+				app.errorLog.Printf("importing %s: %s", fr.Podcast.Feed, fr.Err)
+			}
+
+			results[fr.Podcast.ID].fail(fr.Err)
+		}
+	}
+
+	// ... copy what happened to feeds listed more than once...
+	for i := range results {
+		if j, ok := first[feedURLs[i]]; ok && j != i {
+			results[i].podcast = results[j].podcast
+			results[i].Status = results[j].Status
+			results[i].Message = results[j].Message
+		}
+	}
+
+	// ... then subscribe the user to everything in one go.
+	var podcastIDs []int
+	for i := range results {
+		if results[i].podcast.ID != 0 {
+			results[i].PodcastID = results[i].podcast.ID
+			podcastIDs = append(podcastIDs, results[i].PodcastID)
+		}
+	}
+
+	added, err := app.subscriptions.CreateMany(userID, podcastIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	isAdded := map[int]bool{}
+	for _, id := range added {
+		isAdded[id] = true
+	}
+
+	var backfill []models.Podcast
+	for i := range results {
+		if results[i].PodcastID == 0 {
+			continue
+		}
+
+		if isAdded[results[i].PodcastID] {
+			results[i].Status = importAdded
+			backfill = append(backfill, results[i].podcast)
+
+			// The same podcast can be listed under more than one URL.
+			delete(isAdded, results[i].PodcastID)
+		} else {
+			results[i].Status = importAlreadySubscribed
+		}
+	}
+
+	app.backfillPodcasts(backfill)
+
+	return results, nil
+}
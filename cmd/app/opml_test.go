@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+	"github.com/jinzhu/gorm"
+)
+
+// TestParseOPML tests that we find every feed in an OPML export, however
+// the app that exported it has laid it out.
+func TestParseOPML(t *testing.T) {
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<opml version="2.0">
+	<head><title>Podcast subscriptions</title></head>
+	<body>
+		<outline type="rss" text="First Show" title="First Show" xmlUrl="https://example.com/first.xml" htmlUrl="https://example.com/first"/>
+		<outline text="Folder">
+			<outline type="rss" text="Second Show" xmlUrl="https://example.com/second.xml"/>
+			<outline text="Nested folder">
+				<outline type="rss" text="Third Show" xmlurl="https://example.com/third.xml"/>
+			</outline>
+		</outline>
+		<outline type="link" text="A web page" url="https://example.com/"/>
+		<outline type="rss" text="First Show again" xmlUrl="https://example.com/first.xml"/>
+	</body>
+</opml>`
+
+	got, err := parseOPML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []opmlEntry{
+		{Title: "First Show", URL: "https://example.com/first.xml"},
+		{Title: "Second Show", URL: "https://example.com/second.xml"},
+		{Title: "Third Show", URL: "https://example.com/third.xml"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+// TestParseOPMLInvalid tests that we turn away uploads that aren't OPML.
+func TestParseOPMLInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"RSS feed", rssFixture(1)},
+		{"Plain text", "not even XML"},
+		{"Empty", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOPML(strings.NewReader(tt.doc))
+			if !errors.Is(err, ErrNotOPML) {
+				t.Errorf("want %s, got %v", ErrNotOPML, err)
+			}
+		})
+	}
+}
+
+// TestImportSummary tests that we describe how an import went.
+func TestImportSummary(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		want     string
+	}{
+		{"Everything added", []string{importAdded, importAdded}, "Subscribed to 2 new podcasts."},
+		{"Some already subscribed", []string{importAdded, importAlreadySubscribed}, "Subscribed to 1 new podcast, 1 already subscribed."},
+		{"Some failed", []string{importUnreachable, importInvalid, importAdded}, "Subscribed to 1 new podcast, 2 couldn't be added."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var results []importResult
+			for _, s := range tt.statuses {
+				results = append(results, importResult{Status: s})
+			}
+
+			got := importSummary(results)
+			if got != tt.want {
+				t.Errorf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestImportOPML tests that feeds we don't have yet are only saved once
+// we've checked they work, and are named after the feed rather than the
+// document.
+func TestImportOPML(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+
+	known, err := app.podcasts.CreateFromFeed("Known Show", "https://example.com/known.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed := newTestFeedServer(t, rssFixture(1))
+	defer feed.Close()
+
+	entries := []opmlEntry{
+		{Title: "Known Show", URL: "https://example.com/known.xml"},
+		{Title: "Misnamed Show", URL: feed.URL},
+		{Title: "Dead Show", URL: "http://127.0.0.1:1/dead.xml"},
+		{Title: "Broken", URL: "not a feed url"},
+	}
+
+	results, err := app.importOPML(context.Background(), 1, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{importAdded, importAdded, importUnreachable, importInvalid}
+	for i, r := range results {
+		if r.Status != want[i] {
+			t.Errorf("want %s for %s, got %s", want[i], r.URL, r.Status)
+		}
+	}
+
+	if results[0].PodcastID != known.ID {
+		t.Errorf("want the known show matched to podcast %d, got %d", known.ID, results[0].PodcastID)
+	}
+
+	podcast, err := app.podcasts.Get(results[1].PodcastID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if podcast.Name != "Test Podcast" {
+		t.Errorf("want %s named after its feed, got %q", feed.URL, podcast.Name)
+	}
+
+	_, err = app.podcasts.FindByFeed("http://127.0.0.1:1/dead.xml")
+	if !gorm.IsRecordNotFoundError(err) {
+		t.Errorf("want unreachable feed not to be saved, got %v", err)
+	}
+
+	again, err := app.importOPML(context.Background(), 1, entries[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range again {
+		if r.Status != importAlreadySubscribed {
+			t.Errorf("want %s already subscribed, got %s", r.URL, r.Status)
+		}
+	}
+}
+
+// TestImportSubscriptionsTooLarge tests that uploads over the size limit
+// are turned away before they're read, however they're sent.
+func TestImportSubscriptionsTooLarge(t *testing.T) {
+	app := newTestApplication(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("opml", "subscriptions.opml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte(" "), maxOPMLSize+1))
+	mw.Close()
+
+	handlers := map[string]http.HandlerFunc{
+		"Page": app.importSubscriptions,
+		"API":  app.apiImportSubscriptions,
+	}
+
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/subscriptions/import", bytes.NewReader(body.Bytes()))
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			w := httptest.NewRecorder()
+
+			handler(w, r)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("want %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
+
+// TestSubscriptionsOPML tests that exported subscriptions can be read
+// back in, and are grouped by category when asked.
+func TestSubscriptionsOPML(t *testing.T) {
+	subscriptions := []models.Subscription{
+		{Podcast: models.Podcast{Name: "Zebra Talk", Feed: "https://example.com/zebra.xml", Categories: "Science, Science > Life Sciences"}},
+		{Podcast: models.Podcast{Name: "apple chat", Feed: "https://example.com/apple.xml", Link: "https://example.com/apple"}},
+		{Podcast: models.Podcast{Name: "Middle", Feed: "https://example.com/middle.xml", Categories: "Arts"}},
+	}
+	now := time.Date(2020, time.June, 1, 9, 0, 0, 0, time.UTC)
+
+	t.Run("Round trip", func(t *testing.T) {
+		body, err := xml.Marshal(subscriptionsOPML(subscriptions, false, now))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := parseOPML(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []opmlEntry{
+			{Title: "apple chat", URL: "https://example.com/apple.xml"},
+			{Title: "Middle", URL: "https://example.com/middle.xml"},
+			{Title: "Zebra Talk", URL: "https://example.com/zebra.xml"},
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %+v, got %+v", want, got)
+		}
+	})
+
+	t.Run("By category", func(t *testing.T) {
+		doc := subscriptionsOPML(subscriptions, true, now)
+
+		var got []string
+		for _, o := range doc.Body.Outlines {
+			got = append(got, o.Text)
+		}
+
+		want := []string{"Arts", "Science", "apple chat"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+
+		zebra := doc.Body.Outlines[1].Outlines[0]
+		if zebra.Category != "/Science,/Science/Life Sciences" {
+			t.Errorf("want %q, got %q", "/Science,/Science/Life Sciences", zebra.Category)
+		}
+	})
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// maxExtraSize is the most we'll read of a chapters or transcript file.
+const maxExtraSize = 5 << 20
+
+// extrasBatchSize is the most chapters files, and the most transcripts,
+// we fetch for a podcast each time it's saved. Anything left over waits
+// until the next time.
+const extrasBatchSize = 20
+
+// extraClient fetches chapters and transcripts, giving up on any one file
+// that takes too long.
+var extraClient = &http.Client{Timeout: 15 * time.Second}
+
+// FeedChapters is a podcast:chapters link to an episode's chapters file.
+type FeedChapters struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// FeedTranscript is a podcast:transcript link. An episode can have a few
+// of these, in different formats or languages.
+type FeedTranscript struct {
+	URL      string `xml:"url,attr"`
+	Type     string `xml:"type,attr"`
+	Language string `xml:"language,attr"`
+	Rel      string `xml:"rel,attr"`
+}
+
+// FeedPerson is a podcast:person, listed against either an episode or
+// the whole channel.
+type FeedPerson struct {
+	Name  string `xml:",chardata"`
+	Role  string `xml:"role,attr"`
+	Group string `xml:"group,attr"`
+	Image string `xml:"img,attr"`
+	Href  string `xml:"href,attr"`
+}
+
+// FeedPodcastSeason is a podcast:season, which is a season number with
+// an optional name.
+type FeedPodcastSeason struct {
+	Number string `xml:",chardata"`
+	Name   string `xml:"name,attr"`
+}
+
+// toPeople converts people from the feed into the people we store.
+func toPeople(fps []FeedPerson) []models.Person {
+	var people []models.Person
+
+	for _, fp := range fps {
+		name := strings.TrimSpace(fp.Name)
+		if name == "" {
+			continue
+		}
+
+		// The spec defaults people to being hosts in the cast.
+		role := strings.ToLower(strings.TrimSpace(fp.Role))
+		if role == "" {
+			role = "host"
+		}
+
+		group := strings.ToLower(strings.TrimSpace(fp.Group))
+		if group == "" {
+			group = "cast"
+		}
+
+		people = append(people, models.Person{
+			Name:     name,
+			Role:     role,
+			Group:    group,
+			ImageURL: strings.TrimSpace(fp.Image),
+			Href:     strings.TrimSpace(fp.Href),
+		})
+	}
+
+	return people
+}
+
+// toTranscripts converts transcript links from the feed into the
+// transcripts we store. The text is fetched separately.
+func toTranscripts(fts []FeedTranscript) []models.Transcript {
+	var transcripts []models.Transcript
+
+	for _, ft := range fts {
+		if strings.TrimSpace(ft.URL) == "" {
+			continue
+		}
+
+		transcripts = append(transcripts, models.Transcript{
+			URL:      strings.TrimSpace(ft.URL),
+			Type:     strings.TrimSpace(ft.Type),
+			Language: strings.TrimSpace(ft.Language),
+			Rel:      strings.TrimSpace(ft.Rel),
+		})
+	}
+
+	return transcripts
+}
+
+// peopleUnchanged checks whether the people we've stored for an episode
+// match the ones in the feed.
+func peopleUnchanged(stored, fetched []models.Person) bool {
+	if len(stored) != len(fetched) {
+		return false
+	}
+
+	for i := range stored {
+		s, f := stored[i], fetched[i]
+		if s.Name != f.Name || s.Role != f.Role || s.Group != f.Group || s.ImageURL != f.ImageURL || s.Href != f.Href {
+			return false
+		}
+	}
+
+	return true
+}
+
+// transcriptsUnchanged checks whether the transcripts we've stored for an
+// episode match the ones in the feed.
+func transcriptsUnchanged(stored, fetched []models.Transcript) bool {
+	if len(stored) != len(fetched) {
+		return false
+	}
+
+	for i := range stored {
+		s, f := stored[i], fetched[i]
+		if s.URL != f.URL || s.Type != f.Type || s.Language != f.Language || s.Rel != f.Rel {
+			return false
+		}
+	}
+
+	return true
+}
+
+// jsonChapters is the JSON chapters format used by podcast:chapters.
+type jsonChapters struct {
+	Version  string `json:"version"`
+	Chapters []struct {
+		StartTime float64 `json:"startTime"`
+		Title     string  `json:"title"`
+		Img       string  `json:"img"`
+		URL       string  `json:"url"`
+		TOC       *bool   `json:"toc"`
+	} `json:"chapters"`
+}
+
+// parseChapters reads a JSON chapters file. Chapters marked as not being
+// part of the table of contents are left out.
+func parseChapters(body []byte) ([]models.Chapter, error) {
+	var jc jsonChapters
+	var chapters []models.Chapter
+
+	err := json.Unmarshal(body, &jc)
+	if err != nil {
+		return chapters, err
+	}
+
+	for _, c := range jc.Chapters {
+		if c.TOC != nil && !*c.TOC {
+			continue
+		}
+
+		chapters = append(chapters, models.Chapter{
+			StartTime: c.StartTime,
+			Title:     strings.TrimSpace(c.Title),
+			ImageURL:  strings.TrimSpace(c.Img),
+			URL:       strings.TrimSpace(c.URL),
+		})
+	}
+
+	return chapters, nil
+}
+
+// transcriptText converts a transcript in any of the formats allowed by
+// podcast:transcript into plain text.
+func transcriptText(contentType string, body []byte) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "application/json":
+		var jt struct {
+			Segments []struct {
+				Body string `json:"body"`
+			} `json:"segments"`
+		}
+
+		err := json.Unmarshal(body, &jt)
+		if err != nil {
+			return "", err
+		}
+
+		var parts []string
+		for _, s := range jt.Segments {
+			parts = append(parts, strings.TrimSpace(s.Body))
+		}
+
+		return strings.Join(strings.Fields(strings.Join(parts, " ")), " "), nil
+	case "text/vtt", "application/srt", "application/x-subrip", "text/srt":
+		return cueText(string(body)), nil
+	case "text/html":
+		return stripTags(string(body)), nil
+	default:
+		return strings.TrimSpace(string(body)), nil
+	}
+}
+
+// cueText pulls the spoken text out of an SRT or WebVTT file, dropping
+// cue numbers, timings, headers and notes.
+func cueText(body string) string {
+	var lines []string
+	skipping := false
+	last := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(strings.Replace(body, "\r\n", "\n", -1)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			skipping = false
+			continue
+		case skipping:
+			continue
+		case strings.HasPrefix(line, "WEBVTT"), strings.HasPrefix(line, "NOTE"), line == "STYLE", line == "REGION":
+			skipping = true
+			continue
+		case strings.Contains(line, "-->"):
+			continue
+		}
+
+		if _, err := strconv.Atoi(line); err == nil {
+			continue
+		}
+
+		line = stripTags(line)
+		if line == "" || line == last {
+			continue
+		}
+
+		lines = append(lines, line)
+		last = line
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// fetchExtra downloads a chapters or transcript file, returning its body
+// and content type.
+func fetchExtra(ctx context.Context, url string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := extraClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxExtraSize))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// fetchExtras downloads a batch of the chapters and transcripts of a
+// podcast's episodes that we haven't got yet, stopping early if ctx is
+// done. Chapters are only marked as fetched once we've read them, so
+// problems with a file are logged and it's tried again the next time the
+// podcast is saved.
+func (app *application) fetchExtras(ctx context.Context, podcastID int) error {
+	episodes, err := app.episodes.FindChaptersUnfetched(podcastID, extrasBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, episode := range episodes {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		body, _, err := fetchExtra(ctx, episode.ChaptersURL)
+		var chapters []models.Chapter
+		if err == nil {
+			chapters, err = parseChapters(body)
+		}
+		if err != nil {
+			app.infoLog.Printf("warning: chapters for episode %d: %s", episode.ID, err)
+			continue
+		}
+
+		err = app.chapters.Replace(episode.ID, chapters)
+		if err != nil {
+			return err
+		}
+
+		err = app.episodes.SetChaptersFetched(episode.ID, episode.ChaptersURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	unfetched, err := app.transcripts.FindUnfetched(podcastID, extrasBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range unfetched {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		body, contentType, err := fetchExtra(ctx, t.URL)
+		if err != nil {
+			app.infoLog.Printf("warning: transcript for episode %d: %s", t.EpisodeID, err)
+			continue
+		}
+
+		if t.Type != "" {
+			contentType = t.Type
+		}
+
+		text, err := transcriptText(contentType, body)
+		if err != nil {
+			app.infoLog.Printf("warning: transcript for episode %d: %s", t.EpisodeID, err)
+			continue
+		}
+
+		err = app.transcripts.SetText(t.ID, text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchExtrasLater fetches a podcast's chapters and transcripts in the
+// background, through the fetcher. If it's too busy, they're left until
+// the podcast is next saved.
+func (app *application) fetchExtrasLater(podcastID int) {
+	started := app.fetcher.background(func(ctx context.Context) {
+		err := app.fetchExtras(ctx, podcastID)
+		if err != nil {
+			app.errorLog.Printf("fetching extras for podcast %d: %s", podcastID, err)
+		}
+	})
+	if !started {
+		app.infoLog.Printf("warning: too busy to fetch extras for podcast %d", podcastID)
+	}
+}
+
+// saveChannel stores the details we read from the feed's channel, rather
+// than its items.
+func (app *application) saveChannel(podcastID int, channel FeedChannel) error {
+	err := app.podcasts.UpdateChannel(podcastID, channel.details())
+	if err != nil {
+		return err
+	}
+
+	return app.people.Replace(podcastID, 0, toPeople(channel.Persons))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFeedPodcastingNamespace tests that we read the Podcasting 2.0
+// elements from both the channel and its items.
+func TestFeedPodcastingNamespace(t *testing.T) {
+	body := `<rss version="2.0" xmlns:podcast="https://podcastindex.org/namespace/1.0">
+		<channel>
+			<podcast:guid>917393e3-1b1e-5cef-ace4-edaa54e1f810</podcast:guid>
+			<podcast:person href="https://example.com/host">Jane Host</podcast:person>
+			<item>
+				<title>An interview</title>
+				<guid>ep-1</guid>
+				<podcast:season name="Road trip">2</podcast:season>
+				<podcast:chapters url="https://example.com/1/chapters.json" type="application/json+chapters"/>
+				<podcast:transcript url="https://example.com/1/transcript.vtt" type="text/vtt"/>
+				<podcast:transcript url="https://example.com/1/transcript.srt" type="application/srt" language="es"/>
+				<podcast:person role="Guest" img="https://example.com/guest.jpg">Joe Guest</podcast:person>
+			</item>
+		</channel>
+	</rss>`
+
+	var feed FeedResults
+	err := xml.Unmarshal([]byte(body), &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := feed.Channel
+	if channel.PodcastGUID != "917393e3-1b1e-5cef-ace4-edaa54e1f810" {
+		t.Errorf("want podcast:guid, got %q", channel.PodcastGUID)
+	}
+
+	hosts := toPeople(channel.Persons)
+	if len(hosts) != 1 || hosts[0].Role != "host" || hosts[0].Group != "cast" {
+		t.Errorf("want a host with default role and group, got %+v", hosts)
+	}
+
+	item := channel.Items[0]
+	if item.GUID != "ep-1" {
+		t.Errorf("want item guid %q, got %q", "ep-1", item.GUID)
+	}
+
+	ep := item.toEpisode(1, 0, time.Now())
+	if ep.Season != 2 || ep.SeasonName != "Road trip" {
+		t.Errorf("want season 2 %q, got %d %q", "Road trip", ep.Season, ep.SeasonName)
+	}
+
+	if ep.ChaptersURL != "https://example.com/1/chapters.json" {
+		t.Errorf("want chapters URL, got %q", ep.ChaptersURL)
+	}
+
+	transcripts := toTranscripts(item.Transcripts)
+	if len(transcripts) != 2 || transcripts[1].Language != "es" {
+		t.Errorf("want two transcripts, got %+v", transcripts)
+	}
+
+	guests := toPeople(item.Persons)
+	if len(guests) != 1 || guests[0].Name != "Joe Guest" || guests[0].Role != "guest" {
+		t.Errorf("want a guest, got %+v", guests)
+	}
+}
+
+// TestParseChapters tests that we read JSON chapters, leaving out any
+// that aren't part of the table of contents.
+func TestParseChapters(t *testing.T) {
+	body := `{
+		"version": "1.2.0",
+		"chapters": [
+			{"startTime": 0, "title": "Intro"},
+			{"startTime": 62.5, "title": "Sponsor", "toc": false},
+			{"startTime": 3723, "title": "The interview", "url": "https://example.com"}
+		]
+	}`
+
+	chapters, err := parseChapters([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chapters) != 2 {
+		t.Fatalf("want %d, got %d chapters", 2, len(chapters))
+	}
+
+	if chapters[1].Title != "The interview" || timestamp(chapters[1].StartTime) != "1:02:03" {
+		t.Errorf("want the interview at 1:02:03, got %q at %s", chapters[1].Title, timestamp(chapters[1].StartTime))
+	}
+}
+
+// TestTranscriptText tests that each transcript format is converted to
+// plain text.
+func TestTranscriptText(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			"WebVTT",
+			"text/vtt",
+			"WEBVTT\nKind: captions\n\nNOTE a comment\nspanning lines\n\n00:00.000 --> 00:02.000\n<v Jane>Hello there.\n\n00:02.000 --> 00:04.000\nHello there.\n\n00:04.000 --> 00:06.000\nWelcome back.\n",
+			"Hello there.\nWelcome back.",
+		},
+		{
+			"SRT",
+			"application/srt",
+			"1\r\n00:00:00,000 --> 00:00:02,000\r\nHello there.\r\n\r\n2\r\n00:00:02,000 --> 00:00:04,000\r\nWelcome back.\r\n",
+			"Hello there.\nWelcome back.",
+		},
+		{
+			"JSON",
+			"application/json",
+			`{"version": "1.0.0", "segments": [{"speaker": "Jane", "body": "Hello"}, {"body": "there."}]}`,
+			"Hello there.",
+		},
+		{
+			"HTML",
+			"text/html; charset=utf-8",
+			"<p>Hello there.</p><p>Welcome back.</p>",
+			"Hello there. Welcome back.",
+		},
+		{
+			"Plain",
+			"text/plain",
+			"  Hello there.\n",
+			"Hello there.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := transcriptText(tt.contentType, []byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestFetchExtras tests that chapters which fail to download are tried
+// again, and that chapters and transcripts we've got aren't fetched again.
+func TestFetchExtras(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+
+	extras := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/chapters.json":
+			if n == 1 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"version": "1.2.0", "chapters": [{"startTime": 0, "title": "Intro"}]}`))
+		case "/transcript.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("Hello and welcome."))
+		}
+	}))
+	defer extras.Close()
+
+	app := newTestApplicationWithDB(t)
+
+	// With no workers, nothing is fetched in the background, so the test
+	// can fetch the extras itself.
+	app.fetcher = &fetcher{Timeout: 5 * time.Second}
+
+	podcast, err := app.podcasts.CreateFromFeed("Test Podcast", "https://example.com/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `<rss version="2.0" xmlns:podcast="https://podcastindex.org/namespace/1.0"><channel>
+		<title>Test Podcast</title>
+		<item>
+			<title>Episode 1</title>
+			<guid>ep-1</guid>
+			<enclosure url="https://example.com/1.mp3" type="audio/mpeg"/>
+			<podcast:chapters url="` + extras.URL + `/chapters.json" type="application/json+chapters"/>
+			<podcast:transcript url="` + extras.URL + `/transcript.txt" type="text/plain"/>
+		</item>
+	</channel></rss>`
+
+	var feed FeedResults
+	err = xml.Unmarshal([]byte(body), &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.saveEpisodes(podcast.ID, feed.Channel.Items, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	episodes, err := app.episodes.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	episode := episodes[0]
+
+	err = app.fetchExtras(context.Background(), podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := app.episodes.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if saved[0].ChaptersFetchedAt != nil {
+		t.Error("want chapters that failed to download left unfetched, got them marked fetched")
+	}
+
+	for i := 0; i < 2; i++ {
+		err = app.fetchExtras(context.Background(), podcast.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chapters, err := app.chapters.FindByEpisodeIDs([]uint{episode.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chapters) != 1 || chapters[0].Title != "Intro" {
+		t.Errorf("want the intro chapter, got %+v", chapters)
+	}
+
+	transcripts, err := app.transcripts.FindByEpisodeIDs([]uint{episode.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transcripts) != 1 || transcripts[0].Text != "Hello and welcome." {
+		t.Errorf("want the transcript's text, got %+v", transcripts)
+	}
+
+	// Saving a change to the episode keeps what we've fetched.
+	feed.Channel.Items[0].Title = "Episode 1 (remastered)"
+
+	_, err = app.saveEpisodes(podcast.ID, feed.Channel.Items, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.fetchExtras(context.Background(), podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if n := requests["/chapters.json"]; n != 2 {
+		t.Errorf("want chapters fetched %d times, got %d", 2, n)
+	}
+
+	if n := requests["/transcript.txt"]; n != 1 {
+		t.Errorf("want transcript fetched %d times, got %d", 1, n)
+	}
+}
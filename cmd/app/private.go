@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrPrivateFeedsOff is returned when someone tries to add a private feed
+// but we've no key to encrypt it with.
+var ErrPrivateFeedsOff = errors.New("private feeds are turned off")
+
+// feedKeySize is the size of the key private feeds are encrypted with,
+// which makes them AES-256.
+const feedKeySize = 32
+
+// feedKey gets the key to encrypt private feeds with. A dedicated key,
+// given as base64 or hex, is used if there is one. Otherwise the key is
+// derived from the app secret, so that private feeds work without any more
+// setup, though then changing the app secret makes them unreadable.
+func feedKey(dedicated, appSecret string) ([]byte, error) {
+	if dedicated != "" {
+		for _, decode := range []func(string) ([]byte, error){hex.DecodeString, base64.StdEncoding.DecodeString} {
+			key, err := decode(dedicated)
+			if err == nil && len(key) == feedKeySize {
+				return key, nil
+			}
+		}
+
+		return nil, fmt.Errorf("feed encryption key must be %d bytes, as base64 or hex", feedKeySize)
+	}
+
+	if appSecret == "" {
+		return nil, ErrPrivateFeedsOff
+	}
+
+	key := make([]byte, feedKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(appSecret), nil, []byte("podcast-stats private feeds")), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// feedSealer encrypts and decrypts the URLs of private feeds, along with
+// any credentials in them. Each URL is sealed to the user who owns it, so
+// one user's secret can't be passed off as another's.
+type feedSealer struct {
+	aead cipher.AEAD
+}
+
+// newFeedSealer makes a feedSealer which uses AES-GCM with the given key.
+func newFeedSealer(key []byte) (*feedSealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &feedSealer{aead: aead}, nil
+}
+
+// seal encrypts a user's feed URL, returning it as base64 with the nonce
+// in front.
+func (s *feedSealer) seal(ownerID uint, feedURL string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, []byte(feedURL), ownerData(ownerID))
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a feed URL sealed for a user.
+func (s *feedSealer) open(ownerID uint, secret string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("private feed secret is too short")
+	}
+
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:], ownerData(ownerID))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// ownerData is the additional data a user's feed URLs are sealed with.
+func ownerData(ownerID uint) []byte {
+	return []byte("owner:" + strconv.FormatUint(uint64(ownerID), 10))
+}
+
+// withCredentials adds a username and password to a feed URL, for feeds
+// that use HTTP basic auth. Go sends credentials in a URL as basic auth,
+// so this is all we need to keep. A URL's own credentials are kept unless
+// new ones are given.
+func withCredentials(feedURL, username, password string) (string, error) {
+	if username == "" && password == "" {
+		return feedURL, nil
+	}
+
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidFeedURL, err)
+	}
+
+	u.User = url.UserPassword(username, password)
+
+	return u.String(), nil
+}
+
+// hasCredentials checks whether a feed URL has a username or password in
+// it, which means it can only be added privately.
+func hasCredentials(feedURL string) bool {
+	u, err := url.Parse(feedURL)
+
+	return err == nil && u.User != nil
+}
+
+// feedLabel gets the part of a private feed's URL that's safe to show
+// people and to log: just its scheme and host. Tokens tend to turn up
+// anywhere from the path onwards.
+func feedLabel(feedURL string) string {
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Host == "" {
+		return "private feed"
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// keepCredentials carries the credentials from a private feed's old URL
+// over to the URL it's moving to, if the new URL doesn't have its own and
+// is on the same host. Redirects and new feed URLs don't come with
+// credentials, but paid feeds usually still want them.
+func keepCredentials(oldURL, newURL string) string {
+	o, err := url.Parse(oldURL)
+	if err != nil || o.User == nil {
+		return newURL
+	}
+
+	n, err := url.Parse(newURL)
+	if err != nil || n.User != nil || !strings.EqualFold(n.Host, o.Host) {
+		return newURL
+	}
+
+	n.User = o.User
+
+	return n.String()
+}
+
+// redactedError hides a private feed's real URL in an error, so that it
+// isn't logged or stored along with the podcast's fetch history.
+type redactedError struct {
+	err     error
+	feedURL string
+	label   string
+}
+
+// Error gets the message of the underlying error, with the feed's URL
+// replaced by its label.
+func (e *redactedError) Error() string {
+	msg := e.err.Error()
+
+	for _, secret := range redactions(e.feedURL) {
+		msg = strings.ReplaceAll(msg, secret, e.label)
+	}
+
+	return msg
+}
+
+// Unwrap gets the underlying error.
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactions are the forms a feed's URL can take in an error message,
+// longest first. Go's HTTP client quotes URLs with the password masked,
+// and url.Parse quotes them as given.
+func redactions(feedURL string) []string {
+	secrets := []string{feedURL}
+
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return secrets
+	}
+
+	if password, ok := u.User.Password(); ok {
+		secrets = append(secrets, strings.Replace(u.String(), ":"+password+"@", ":***@", 1))
+	}
+
+	if u.User != nil {
+		bare := *u
+		bare.User = nil
+		secrets = append(secrets, bare.String())
+	}
+
+	return secrets
+}
+
+// redactFeed hides a private podcast's real feed URL in an error.
+func redactFeed(err error, feedURL, label string) error {
+	if err == nil || feedURL == "" {
+		return err
+	}
+
+	return &redactedError{err: err, feedURL: feedURL, label: label}
+}
+
+// unsealFeed gets a copy of a private podcast with its real feed URL in
+// place of its label, ready to be fetched. Other podcasts are returned as
+// they are.
+func (app *application) unsealFeed(podcast models.Podcast) (models.Podcast, error) {
+	if !podcast.Private() {
+		return podcast, nil
+	}
+
+	if app.feeds == nil {
+		return podcast, ErrPrivateFeedsOff
+	}
+
+	feedURL, err := app.feeds.open(*podcast.OwnerID, podcast.FeedSecret)
+	if err != nil {
+		return podcast, fmt.Errorf("decrypting podcast %d's feed: %w", podcast.ID, err)
+	}
+
+	podcast.Feed = feedURL
+
+	return podcast, nil
+}
+
+// privatePodcast finds or creates a user's private copy of the podcast at
+// a feed URL. New feeds are fetched to make sure they work before they're
+// saved.
+func (app *application) privatePodcast(ctx context.Context, ownerID uint, feedURL string) (models.Podcast, error) {
+	podcast, found, err := app.findPrivatePodcast(ownerID, feedURL)
+	if err != nil || found {
+		return podcast, err
+	}
+
+	name, finalURL, err := app.fetcher.checkFeed(ctx, feedURL)
+	if err != nil {
+		return models.Podcast{}, redactFeed(err, feedURL, feedLabel(feedURL))
+	}
+
+	return app.createPrivatePodcast(ownerID, name, keepCredentials(feedURL, finalURL))
+}
+
+// findPrivatePodcast looks for a user's private copy of the podcast at a
+// feed URL. Their private feeds are encrypted, so each one has to be
+// decrypted to compare it.
+func (app *application) findPrivatePodcast(ownerID uint, feedURL string) (models.Podcast, bool, error) {
+	if app.feeds == nil {
+		return models.Podcast{}, false, ErrPrivateFeedsOff
+	}
+
+	existing, err := app.podcasts.FindPrivate(ownerID)
+	if err != nil {
+		return models.Podcast{}, false, err
+	}
+
+	for _, podcast := range existing {
+		unsealed, err := app.unsealFeed(podcast)
+		if err != nil {
+			app.errorLog.Printf("%s", err)
+			continue
+		}
+
+		if unsealed.Feed == feedURL {
+			return podcast, true, nil
+		}
+	}
+
+	return models.Podcast{}, false, nil
+}
+
+// createPrivatePodcast saves a user's private podcast at a feed URL, which
+// is encrypted, and shown by its label.
+func (app *application) createPrivatePodcast(ownerID uint, name, feedURL string) (models.Podcast, error) {
+	if app.feeds == nil {
+		return models.Podcast{}, ErrPrivateFeedsOff
+	}
+
+	secret, err := app.feeds.seal(ownerID, feedURL)
+	if err != nil {
+		return models.Podcast{}, err
+	}
+
+	return app.podcasts.CreatePrivate(ownerID, name, feedLabel(feedURL), secret)
+}
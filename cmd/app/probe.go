@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// probeSize is how much of an enclosure we read at a time when probing
+	// its duration. It's enough for the headers we need, and for all but
+	// the largest ID3 tags.
+	probeSize = 256 << 10
+
+	// probeBatchSize is the most episodes we'll probe in one go.
+	probeBatchSize = 20
+)
+
+// ErrUnknownAudioFormat is returned when we can't tell what kind of audio
+// an enclosure is, so can't probe its duration.
+var ErrUnknownAudioFormat = errors.New("unknown audio format")
+
+// rangeReader reads parts of a remote file with HTTP range requests,
+// keeping track of the file's total size as servers tell us about it.
+type rangeReader struct {
+	ctx   context.Context
+	url   string
+	total int64
+}
+
+// read gets n bytes of the file starting at start, or the last n bytes if
+// start is negative. It can return fewer bytes if the file is shorter.
+func (r *rangeReader) read(start, n int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(r.ctx, "GET", r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if start < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=-%d", n))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+n-1))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if total := contentRangeTotal(resp.Header.Get("Content-Range")); total > 0 {
+			r.total = total
+		}
+	case http.StatusOK:
+		// The server has ignored the range and is sending the whole file,
+		// which is only any use to us if we wanted the start of it.
+		if resp.ContentLength > 0 {
+			r.total = resp.ContentLength
+		}
+		if start != 0 {
+			return nil, fmt.Errorf("probing %s: server doesn't support range requests", r.url)
+		}
+	default:
+		return nil, fmt.Errorf("probing %s: %s", r.url, resp.Status)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, n))
+}
+
+// contentRangeTotal gets the total size of a file from a Content-Range
+// header like "bytes 0-99/1234", or 0 if it isn't given.
+func contentRangeTotal(header string) int64 {
+	i := strings.LastIndex(header, "/")
+	if i < 0 {
+		return 0
+	}
+
+	total, err := strconv.ParseInt(strings.TrimSpace(header[i+1:]), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return total
+}
+
+// probeDuration works out the duration of an enclosure in seconds by
+// reading its headers. It understands MP3, MP4/M4A and Ogg (Opus and
+// Vorbis). The enclosure's length from the feed is used for constant
+// bitrate MP3s if the server doesn't tell us the file's size.
+func probeDuration(ctx context.Context, url string, length int64) (int, error) {
+	r := &rangeReader{ctx: ctx, url: url, total: length}
+
+	head, err := r.read(0, probeSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var secs float64
+	switch {
+	case bytes.HasPrefix(head, []byte("OggS")):
+		secs, err = oggDuration(head, r)
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		secs, err = mp4Duration(head, r)
+	default:
+		secs, err = mp3Duration(head, r)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if secs <= 0 || math.IsInf(secs, 0) || math.IsNaN(secs) {
+		return 0, fmt.Errorf("probing %s: couldn't work out a duration", url)
+	}
+
+	return int(math.Round(secs)), nil
+}
+
+// mp3Bitrates are the bitrates in kbps for each MPEG version and layer,
+// indexed by the bitrate bits of a frame header.
+var mp3Bitrates = map[string][15]int{
+	"1-1": {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	"1-2": {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	"1-3": {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	"2-1": {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	"2-2": {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	"2-3": {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// mp3SampleRates are the sample rates for each MPEG version, indexed by the
+// sample rate bits of a frame header. Version 2.5 is stored as 25.
+var mp3SampleRates = map[int][3]int{
+	1:  {44100, 48000, 32000},
+	2:  {22050, 24000, 16000},
+	25: {11025, 12000, 8000},
+}
+
+// mp3Frame is the parts of an MP3 frame header we need.
+type mp3Frame struct {
+	version    int
+	layer      int
+	bitrate    int
+	sampleRate int
+	padding    int
+	mono       bool
+}
+
+// parseMP3Frame reads a frame header, returning false if it isn't one.
+func parseMP3Frame(h []byte) (mp3Frame, bool) {
+	var f mp3Frame
+
+	if len(h) < 4 || h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return f, false
+	}
+
+	switch (h[1] >> 3) & 3 {
+	case 0:
+		f.version = 25
+	case 2:
+		f.version = 2
+	case 3:
+		f.version = 1
+	default:
+		return f, false
+	}
+
+	switch (h[1] >> 1) & 3 {
+	case 1:
+		f.layer = 3
+	case 2:
+		f.layer = 2
+	case 3:
+		f.layer = 1
+	default:
+		return f, false
+	}
+
+	bitrateIndex := int(h[2] >> 4)
+	sampleRateIndex := int((h[2] >> 2) & 3)
+	if bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return f, false
+	}
+
+	tableVersion := f.version
+	if tableVersion == 25 {
+		tableVersion = 2
+	}
+
+	f.bitrate = mp3Bitrates[fmt.Sprintf("%d-%d", tableVersion, f.layer)][bitrateIndex] * 1000
+	f.sampleRate = mp3SampleRates[f.version][sampleRateIndex]
+	f.padding = int((h[2] >> 1) & 1)
+	f.mono = h[3]>>6 == 3
+
+	return f, true
+}
+
+// samples is how many samples each frame holds.
+func (f mp3Frame) samples() int {
+	switch {
+	case f.layer == 1:
+		return 384
+	case f.layer == 3 && f.version != 1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// size is the length of the frame in bytes, including its header.
+func (f mp3Frame) size() int {
+	if f.layer == 1 {
+		return (12*f.bitrate/f.sampleRate + f.padding) * 4
+	}
+
+	return f.samples()/8*f.bitrate/f.sampleRate + f.padding
+}
+
+// sideInfoSize is the length of the side information which comes between
+// the header of the first frame and any Xing header.
+func (f mp3Frame) sideInfoSize() int {
+	switch {
+	case f.version == 1 && f.mono:
+		return 17
+	case f.version == 1:
+		return 32
+	case f.mono:
+		return 9
+	default:
+		return 17
+	}
+}
+
+// mp3Duration works out the duration of an MP3. Variable bitrate files
+// have a Xing or VBRI header in their first frame which gives the number
+// of frames. Otherwise, we assume a constant bitrate and divide the size of
+// the audio by it.
+func mp3Duration(head []byte, r *rangeReader) (float64, error) {
+	var base int64
+
+	// Skip any ID3v2 tag, which can be big enough that we need to read
+	// again from the end of it.
+	if len(head) >= 10 && bytes.HasPrefix(head, []byte("ID3")) {
+		size := int64(head[6]&0x7f)<<21 | int64(head[7]&0x7f)<<14 | int64(head[8]&0x7f)<<7 | int64(head[9]&0x7f)
+		base = 10 + size
+		if head[5]&0x10 != 0 {
+			base += 10
+		}
+
+		if base+4 > int64(len(head)) {
+			var err error
+			head, err = r.read(base, probeSize)
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			head = head[base:]
+		}
+	}
+
+	// Find the first frame, checking that it's followed by another so we
+	// don't mistake stray bytes for a header.
+	start := -1
+	var frame mp3Frame
+	for i := 0; i+4 <= len(head); i++ {
+		f, ok := parseMP3Frame(head[i:])
+		if !ok {
+			continue
+		}
+
+		next := i + f.size()
+		if next+4 <= len(head) {
+			if _, ok := parseMP3Frame(head[next:]); !ok {
+				continue
+			}
+		}
+
+		start, frame = i, f
+		break
+	}
+
+	if start < 0 {
+		return 0, ErrUnknownAudioFormat
+	}
+
+	perFrame := float64(frame.samples()) / float64(frame.sampleRate)
+
+	// Xing (or Info, for constant bitrate files made by the same tools).
+	xing := start + 4 + frame.sideInfoSize()
+	if xing+12 <= len(head) {
+		tag := string(head[xing : xing+4])
+		flags := binary.BigEndian.Uint32(head[xing+4:])
+		if (tag == "Xing" || tag == "Info") && flags&1 != 0 {
+			frames := binary.BigEndian.Uint32(head[xing+8:])
+			return float64(frames) * perFrame, nil
+		}
+	}
+
+	// VBRI, which always comes 32 bytes after the header.
+	vbri := start + 4 + 32
+	if vbri+18 <= len(head) && string(head[vbri:vbri+4]) == "VBRI" {
+		frames := binary.BigEndian.Uint32(head[vbri+14:])
+		return float64(frames) * perFrame, nil
+	}
+
+	if r.total <= 0 {
+		return 0, errors.New("can't work out the duration of a constant bitrate MP3 without its size")
+	}
+
+	audio := r.total - base - int64(start)
+
+	return float64(audio) * 8 / float64(frame.bitrate), nil
+}
+
+// mp4Duration works out the duration of an MP4 or M4A from the movie
+// header (mvhd) inside its moov box. The moov box is often after the
+// audio, in which case we skip over the audio and read again from there.
+func mp4Duration(head []byte, r *rangeReader) (float64, error) {
+	buf, bufStart := head, int64(0)
+	pos := int64(0)
+
+	for i := 0; i < 64; i++ {
+		// Make sure we have this box's header to hand.
+		if pos+16 > bufStart+int64(len(buf)) {
+			if r.total > 0 && pos >= r.total {
+				break
+			}
+
+			var err error
+			buf, err = r.read(pos, probeSize)
+			if err != nil {
+				return 0, err
+			}
+			bufStart = pos
+		}
+
+		b := buf[pos-bufStart:]
+		if len(b) < 8 {
+			break
+		}
+
+		size, header := int64(binary.BigEndian.Uint32(b)), int64(8)
+		kind := string(b[4:8])
+		if size == 1 {
+			if len(b) < 16 {
+				break
+			}
+			size, header = int64(binary.BigEndian.Uint64(b[8:])), 16
+		}
+
+		if kind == "moov" {
+			// The mvhd box comes first, but make sure we've got all of it.
+			if int64(len(b)) < size && len(b) < probeSize/2 {
+				var err error
+				b, err = r.read(pos, probeSize)
+				if err != nil {
+					return 0, err
+				}
+			}
+
+			body := b[header:]
+			if size > header && int64(len(body)) > size-header {
+				body = body[:size-header]
+			}
+
+			return mvhdDuration(body)
+		}
+
+		if size < header {
+			break
+		}
+
+		pos += size
+	}
+
+	return 0, errors.New("no moov box in MP4")
+}
+
+// mvhdDuration finds the mvhd box among the children of a moov box and
+// reads the duration from it.
+func mvhdDuration(moov []byte) (float64, error) {
+	for len(moov) >= 8 {
+		size := int(binary.BigEndian.Uint32(moov))
+		kind := string(moov[4:8])
+
+		if kind == "mvhd" {
+			body := moov[8:]
+			if len(body) < 1 {
+				break
+			}
+
+			var timescale, duration uint64
+			if body[0] == 1 {
+				if len(body) < 32 {
+					break
+				}
+				timescale = uint64(binary.BigEndian.Uint32(body[20:]))
+				duration = binary.BigEndian.Uint64(body[24:])
+			} else {
+				if len(body) < 20 {
+					break
+				}
+				timescale = uint64(binary.BigEndian.Uint32(body[12:]))
+				duration = uint64(binary.BigEndian.Uint32(body[16:]))
+			}
+
+			if timescale == 0 {
+				break
+			}
+
+			return float64(duration) / float64(timescale), nil
+		}
+
+		if size < 8 || size > len(moov) {
+			break
+		}
+		moov = moov[size:]
+	}
+
+	return 0, errors.New("no mvhd box in MP4")
+}
+
+// oggDuration works out the duration of an Ogg file. The first page tells
+// us the codec and sample rate, and the granule position of the last page
+// tells us how many samples there are.
+func oggDuration(head []byte, r *rangeReader) (float64, error) {
+	if len(head) < 27 {
+		return 0, ErrUnknownAudioFormat
+	}
+
+	segments := int(head[26])
+	if len(head) < 27+segments {
+		return 0, ErrUnknownAudioFormat
+	}
+	packet := head[27+segments:]
+
+	var rate, preSkip float64
+	switch {
+	case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 12:
+		// Opus granule positions are always at 48kHz.
+		rate = 48000
+		preSkip = float64(binary.LittleEndian.Uint16(packet[10:]))
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+		rate = float64(binary.LittleEndian.Uint32(packet[12:]))
+	default:
+		return 0, ErrUnknownAudioFormat
+	}
+
+	if rate == 0 {
+		return 0, ErrUnknownAudioFormat
+	}
+
+	tail, err := r.read(-1, probeSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// Find the last page that has a granule position. Pages where no
+	// packet finishes have a position of -1.
+	for end := len(tail); end > 0; {
+		i := bytes.LastIndex(tail[:end], []byte("OggS"))
+		if i < 0 {
+			break
+		}
+
+		if i+14 <= len(tail) {
+			granule := binary.LittleEndian.Uint64(tail[i+6:])
+			if granule != math.MaxUint64 {
+				return (float64(granule) - preSkip) / rate, nil
+			}
+		}
+
+		end = i
+	}
+
+	return 0, errors.New("no granule position in Ogg file")
+}
+
+// probeDurations probes the durations of a batch of episodes whose feeds
+// don't give one. Episodes we can't probe are marked so we don't keep
+// trying.
+func (app *application) probeDurations() {
+	episodes, err := app.episodes.FindUnprobed(probeBatchSize)
+	if err != nil {
+		app.errorLog.Printf("finding episodes to probe: %s", err)
+		return
+	}
+
+	for _, ep := range episodes {
+		ctx, cancel := context.WithTimeout(context.Background(), app.fetcher.Timeout)
+		secs, err := probeDuration(ctx, ep.Source, ep.EnclosureLength)
+		cancel()
+
+		if err != nil {
+			app.infoLog.Printf("warning: probing duration of episode %d: %s", ep.ID, err)
+		}
+
+		err = app.episodes.SetProbedDuration(ep.ID, secs)
+		if err != nil {
+			app.errorLog.Printf("saving duration of episode %d: %s", ep.ID, err)
+		}
+	}
+}
+
+// runProber probes episode durations every so often, until the program
+// exits.
+func (app *application) runProber(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		app.probeDurations()
+		<-ticker.C
+	}
+}
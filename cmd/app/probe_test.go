@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestAudioServer serves a file with support for range requests.
+func newTestAudioServer(t *testing.T, body []byte) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+}
+
+// mp3Header is the header of an MPEG-1 Layer III frame at 128kbps and
+// 44.1kHz, which is 417 bytes long.
+var mp3Header = []byte{0xff, 0xfb, 0x90, 0x00}
+
+// cbrMP3 builds an MP3 with an ID3 tag and the given number of frames.
+func cbrMP3(frames int) []byte {
+	var b bytes.Buffer
+
+	b.Write([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, 90})
+	b.Write(make([]byte, 90))
+
+	for i := 0; i < frames; i++ {
+		b.Write(mp3Header)
+		b.Write(make([]byte, 417-len(mp3Header)))
+	}
+
+	return b.Bytes()
+}
+
+// xingMP3 builds a variable bitrate MP3 whose Xing header says it has the
+// given number of frames.
+func xingMP3(frames uint32) []byte {
+	first := make([]byte, 417)
+	copy(first, mp3Header)
+	copy(first[36:], "Xing")
+	binary.BigEndian.PutUint32(first[40:], 1)
+	binary.BigEndian.PutUint32(first[44:], frames)
+
+	second := make([]byte, 417)
+	copy(second, mp3Header)
+
+	return append(first, second...)
+}
+
+// mp4Box builds an MP4 box.
+func mp4Box(kind string, body []byte) []byte {
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], kind)
+
+	return append(box, body...)
+}
+
+// m4a builds an M4A with its moov box after a large mdat, as many
+// encoders do.
+func m4a(timescale, duration uint32) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+
+	var b []byte
+	b = append(b, mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00"))...)
+	b = append(b, mp4Box("mdat", make([]byte, probeSize+1000))...)
+	b = append(b, mp4Box("moov", mp4Box("mvhd", mvhd))...)
+
+	return b
+}
+
+// oggPage builds an Ogg page holding a single packet.
+func oggPage(granule uint64, packet []byte) []byte {
+	page := make([]byte, 27)
+	copy(page, "OggS")
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	page[26] = 1
+
+	page = append(page, byte(len(packet)))
+
+	return append(page, packet...)
+}
+
+// opus builds an Ogg Opus file with the given number of samples.
+func opus(samples uint64) []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = 2
+	binary.LittleEndian.PutUint16(head[10:], 312)
+	binary.LittleEndian.PutUint32(head[12:], 48000)
+
+	var b []byte
+	b = append(b, oggPage(0, head)...)
+	b = append(b, oggPage(samples/2+312, make([]byte, 200))...)
+	b = append(b, oggPage(samples+312, make([]byte, 200))...)
+
+	return b
+}
+
+// TestProbeDuration tests that we can work out the duration of the audio
+// formats podcasts are published in.
+func TestProbeDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want int
+	}{
+		{"CBR MP3", cbrMP3(2302), 60},
+		{"Xing MP3", xingMP3(2297), 60},
+		{"M4A with moov at the end", m4a(1000, 90400), 90},
+		{"Ogg Opus", opus(48000 * 120), 120},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestAudioServer(t, tt.body)
+			defer ts.Close()
+
+			got, err := probeDuration(context.Background(), ts.URL, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("want %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestProbeDurationUnknown tests that we give up on files we don't
+// recognise.
+func TestProbeDurationUnknown(t *testing.T) {
+	ts := newTestAudioServer(t, []byte("<html>Not audio</html>"))
+	defer ts.Close()
+
+	_, err := probeDuration(context.Background(), ts.URL, 0)
+	if err == nil {
+		t.Error("want error, got nil")
+	}
+}
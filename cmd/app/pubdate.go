@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PubDateError is returned when an episode's publish date doesn't match
+// any of the formats we know how to read.
+type PubDateError struct {
+	Value string
+}
+
+// Error describes the date that couldn't be parsed.
+func (e *PubDateError) Error() string {
+	return fmt.Sprintf("unrecognised publish date %q", e.Value)
+}
+
+// isoLayouts are the RFC 3339-ish formats we accept. These are tried
+// against the date exactly as it appears in the feed.
+var isoLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05-07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// rfc822Layouts are the RFC 822/1123 formats we accept once a date has
+// been through normalizeRFC822: no weekday, a three-letter month and a
+// numeric zone, if there's a zone at all.
+var rfc822Layouts = []string{
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05 -07:00",
+	"2 Jan 2006 15:04 -07:00",
+	"2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04",
+	"2 Jan 2006",
+	"2 Jan 06 15:04:05 -0700",
+	"2 Jan 06 15:04 -0700",
+	"2 Jan 06 15:04:05",
+	"2 Jan 06 15:04",
+	"2 Jan 06",
+}
+
+// zoneOffsets maps the named zones we see in feeds to numeric offsets.
+// Go's time.Parse only knows the offset of a named zone if it happens to
+// be the local one, and treats any other as UTC, so we swap them out
+// before parsing.
+var zoneOffsets = map[string]string{
+	"UT":   "+0000",
+	"UTC":  "+0000",
+	"GMT":  "+0000",
+	"Z":    "+0000",
+	"EST":  "-0500",
+	"EDT":  "-0400",
+	"CST":  "-0600",
+	"CDT":  "-0500",
+	"MST":  "-0700",
+	"MDT":  "-0600",
+	"PST":  "-0800",
+	"PDT":  "-0700",
+	"AKST": "-0900",
+	"AKDT": "-0800",
+	"HST":  "-1000",
+	"BST":  "+0100",
+	"WET":  "+0000",
+	"WEST": "+0100",
+	"CET":  "+0100",
+	"CEST": "+0200",
+	"EET":  "+0200",
+	"EEST": "+0300",
+	"JST":  "+0900",
+	"KST":  "+0900",
+	"AEST": "+1000",
+	"AEDT": "+1100",
+	"ACST": "+0930",
+	"ACDT": "+1030",
+	"AWST": "+0800",
+	"NZST": "+1200",
+	"NZDT": "+1300",
+}
+
+// parsePubDate reads the publish date of an episode. It handles the many
+// variations on RFC 822 dates found in podcast feeds as well as RFC 3339
+// dates, and returns a *PubDateError if nothing matches.
+func parsePubDate(value string) (time.Time, error) {
+	s := strings.Join(strings.Fields(value), " ")
+	if s == "" {
+		return time.Time{}, &PubDateError{Value: value}
+	}
+
+	for _, layout := range isoLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	s = normalizeRFC822(s)
+	for _, layout := range rfc822Layouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, &PubDateError{Value: value}
+}
+
+// normalizeRFC822 tidies up an RFC 822-style date so it has a chance of
+// matching one of our layouts. It drops the weekday (which is often
+// misspelled, and which we don't need anyway), shortens month names to
+// three letters and swaps named zones for numeric offsets.
+func normalizeRFC822(s string) string {
+	// Drop any trailing comment, like "(PDT)".
+	if i := strings.Index(s, "("); i > 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+
+	fields := strings.Fields(strings.Replace(s, ",", ", ", -1))
+
+	// Drop the weekday, with or without its comma.
+	if len(fields) > 0 && isAlpha(strings.TrimSuffix(fields[0], ",")) {
+		fields = fields[1:]
+	}
+
+	for i, f := range fields {
+		fields[i] = strings.TrimSuffix(f, ",")
+	}
+
+	// Shorten "June" or "Sept" to "Jun" and "Sep".
+	if len(fields) > 1 && len(fields[1]) > 3 && isAlpha(fields[1]) {
+		fields[1] = strings.TrimSuffix(fields[1], ".")[:3]
+	}
+
+	// Swap a named zone for its offset.
+	if len(fields) > 0 {
+		last := len(fields) - 1
+		if offset, ok := zoneOffsets[strings.ToUpper(fields[last])]; ok {
+			fields[last] = offset
+		}
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// isAlpha checks whether a string is made up only of ASCII letters
+// and full stops.
+func isAlpha(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && r != '.' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestParsePubDate tests the variations on publish dates that we
+// see in the wild.
+func TestParsePubDate(t *testing.T) {
+	want := time.Date(2020, time.June, 3, 11, 5, 30, 0, time.UTC)
+	wantNoSeconds := time.Date(2020, time.June, 3, 11, 5, 0, 0, time.UTC)
+	wantDate := time.Date(2020, time.June, 3, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Time
+	}{
+		{"RFC 1123 numeric zone", "Wed, 03 Jun 2020 11:05:30 +0000", want},
+		{"RFC 1123 GMT", "Wed, 03 Jun 2020 11:05:30 GMT", want},
+		{"Named US zone", "Wed, 03 Jun 2020 07:05:30 EDT", want},
+		{"Named Pacific zone", "Wed, 03 Jun 2020 03:05:30 PST", want},
+		{"Lowercase zone", "Wed, 03 Jun 2020 04:05:30 pdt", want},
+		{"Single-digit day", "Wed, 3 Jun 2020 11:05:30 +0000", want},
+		{"Missing seconds", "Wed, 03 Jun 2020 11:05 +0000", wantNoSeconds},
+		{"Two-digit year", "Wed, 03 Jun 20 11:05:30 +0000", want},
+		{"No weekday", "03 Jun 2020 11:05:30 +0000", want},
+		{"Long weekday", "Wednesday, 03 Jun 2020 11:05:30 +0000", want},
+		{"Wrong weekday", "Mon, 03 Jun 2020 11:05:30 +0000", want},
+		{"Weekday without comma", "Wed 03 Jun 2020 11:05:30 +0000", want},
+		{"Full month", "Wed, 03 June 2020 11:05:30 +0000", want},
+		{"Colon in offset", "Wed, 03 Jun 2020 12:05:30 +01:00", want},
+		{"No zone", "Wed, 03 Jun 2020 11:05:30", want},
+		{"Extra whitespace", "  Wed,  03 Jun 2020\n11:05:30 +0000 ", want},
+		{"Trailing comment", "Wed, 03 Jun 2020 04:05:30 -0700 (PDT)", want},
+		{"Date only", "Wed, 03 Jun 2020", wantDate},
+		{"RFC 3339", "2020-06-03T11:05:30Z", want},
+		{"RFC 3339 offset", "2020-06-03T13:05:30+02:00", want},
+		{"ISO without zone", "2020-06-03 11:05:30", want},
+		{"ISO date", "2020-06-03", wantDate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePubDate(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !got.Equal(tt.want) {
+				t.Errorf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestParsePubDateError tests that we report dates we can't read rather
+// than returning a zero time.
+func TestParsePubDateError(t *testing.T) {
+	for _, value := range []string{"", "yesterday", "Wed, 33 Foo 2020"} {
+		_, err := parsePubDate(value)
+
+		var dateErr *PubDateError
+		if !errors.As(err, &dateErr) {
+			t.Errorf("want a *PubDateError for %q, got %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// Ways a reissued episode can be matched to one we already have.
+const (
+	matchedByEnclosure    = "enclosure"
+	matchedByTitleAndDate = "title-and-date"
+)
+
+// orphanedEpisodes gets the stored episodes whose keys no longer appear in
+// the feed. These are the candidates for an episode that has been reissued
+// under a new GUID.
+func orphanedEpisodes(stored []models.Episode, eps []FeedEpisode) []models.Episode {
+	keys := make(map[string]bool, len(eps))
+	for _, ep := range eps {
+		keys[ep.key()] = true
+	}
+
+	var orphans []models.Episode
+	for _, s := range stored {
+		if !keys[s.ItemKey] {
+			orphans = append(orphans, s)
+		}
+	}
+
+	return orphans
+}
+
+// matchReissued looks for the orphaned episode that a fetched episode is a
+// reissue of. A match on the enclosure URL wins; failing that, we accept a
+// match on the title and publish date. Either way, the match has to be
+// unambiguous.
+func matchReissued(orphans []models.Episode, fetched models.Episode) (models.Episode, string, bool) {
+	var byEnclosure, byTitle []models.Episode
+
+	enclosure := normalizeEnclosure(fetched.Source)
+	title := normalizeTitle(fetched.Title)
+
+	for _, o := range orphans {
+		if enclosure != "" && normalizeEnclosure(o.Source) == enclosure {
+			byEnclosure = append(byEnclosure, o)
+		}
+
+		if title != "" && normalizeTitle(o.Title) == title && sameDay(o.PublishedOn, fetched.PublishedOn) {
+			byTitle = append(byTitle, o)
+		}
+	}
+
+	if len(byEnclosure) == 1 {
+		return byEnclosure[0], matchedByEnclosure, true
+	}
+
+	if len(byEnclosure) == 0 && len(byTitle) == 1 {
+		return byTitle[0], matchedByTitleAndDate, true
+	}
+
+	return models.Episode{}, "", false
+}
+
+// withoutEpisode removes an episode from a list of episodes.
+func withoutEpisode(eps []models.Episode, id uint) []models.Episode {
+	var out []models.Episode
+	for _, ep := range eps {
+		if ep.ID != id {
+			out = append(out, ep)
+		}
+	}
+
+	return out
+}
+
+// normalizeEnclosure reduces an enclosure URL to its host and path, since
+// tracking parameters in the query string change all the time.
+func normalizeEnclosure(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+
+	return host + u.Path
+}
+
+// normalizeTitle lowercases a title and strips its punctuation, so that
+// small differences in formatting don't stop a match.
+func normalizeTitle(title string) string {
+	fields := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	return strings.Join(fields, " ")
+}
+
+// sameDay checks whether two publish dates are within a day of each other,
+// which allows for a reissued feed using a different time zone.
+func sameDay(a, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return false
+	}
+
+	d := a.Sub(b)
+	if d < 0 {
+		d = -d
+	}
+
+	return d < 24*time.Hour
+}
+
+// mergeReissued gives the orphaned episode a fetched episode has been
+// matched to the fetched episode's GUID, so that listens stay attached.
+// It returns the stored episode that the fetched one should now be
+// compared against, and the merge to save along with the feed.
+func mergeReissued(orphan, fetched models.Episode, matchedBy string) (models.Episode, models.EpisodeMerge) {
+	merge := models.EpisodeMerge{
+		PodcastID: fetched.PodcastID,
+		EpisodeID: orphan.ID,
+		OldGUID:   orphan.GUID,
+		NewGUID:   fetched.GUID,
+		NewKey:    fetched.ItemKey,
+		MatchedBy: matchedBy,
+		MergedAt:  time.Now(),
+	}
+
+	orphan.GUID = fetched.GUID
+	orphan.ItemKey = fetched.ItemKey
+
+	return orphan, merge
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// TestOrphanedEpisodes tests that only stored episodes missing from the
+// feed are candidates for a reissue.
+func TestOrphanedEpisodes(t *testing.T) {
+	kept := FeedEpisode{GUID: "kept"}
+	stored := []models.Episode{
+		{ID: 1, ItemKey: kept.key()},
+		{ID: 2, ItemKey: (&FeedEpisode{GUID: "gone"}).key()},
+	}
+
+	orphans := orphanedEpisodes(stored, []FeedEpisode{kept, {GUID: "new"}})
+	if len(orphans) != 1 || orphans[0].ID != 2 {
+		t.Errorf("want episode 2 to be orphaned, got %+v", orphans)
+	}
+}
+
+// TestMatchReissued tests how we recognise an episode under a new GUID.
+func TestMatchReissued(t *testing.T) {
+	pub := time.Date(2020, time.June, 3, 11, 0, 0, 0, time.UTC)
+	orphans := []models.Episode{
+		{ID: 1, Title: "Episode 1: The Beginning", Source: "https://www.example.com/audio/1.mp3?token=abc", PublishedOn: pub},
+		{ID: 2, Title: "Episode 2", Source: "https://old-host.com/2.mp3", PublishedOn: pub.AddDate(0, 0, 7)},
+		{ID: 3, Title: "Bonus", Source: "https://old-host.com/bonus-a.mp3", PublishedOn: pub},
+		{ID: 4, Title: "Bonus", Source: "https://old-host.com/bonus-b.mp3", PublishedOn: pub.Add(time.Hour)},
+	}
+
+	tests := []struct {
+		name      string
+		fetched   models.Episode
+		wantID    uint
+		matchedBy string
+	}{
+		{
+			"Same enclosure, new tracking parameters",
+			models.Episode{Title: "Renamed", Source: "https://example.com/audio/1.mp3?token=xyz", PublishedOn: pub.AddDate(1, 0, 0)},
+			1, matchedByEnclosure,
+		},
+		{
+			"New host, same title and day",
+			models.Episode{Title: "episode 2.", Source: "https://new-host.com/2.mp3", PublishedOn: pub.AddDate(0, 0, 7).Add(-5 * time.Hour)},
+			2, matchedByTitleAndDate,
+		},
+		{
+			"Same title, different day",
+			models.Episode{Title: "Episode 2", Source: "https://new-host.com/2.mp3", PublishedOn: pub.AddDate(0, 0, 14)},
+			0, "",
+		},
+		{
+			"Ambiguous title",
+			models.Episode{Title: "Bonus", Source: "https://new-host.com/bonus.mp3", PublishedOn: pub},
+			0, "",
+		},
+		{
+			"Unknown publish date",
+			models.Episode{Title: "Episode 2", Source: "https://new-host.com/2.mp3"},
+			0, "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, matchedBy, ok := matchReissued(orphans, tt.fetched)
+
+			if tt.wantID == 0 {
+				if ok {
+					t.Errorf("want no match, got episode %d", match.ID)
+				}
+				return
+			}
+
+			if !ok || match.ID != tt.wantID || matchedBy != tt.matchedBy {
+				t.Errorf("want episode %d by %s, got %d by %s", tt.wantID, tt.matchedBy, match.ID, matchedBy)
+			}
+		})
+	}
+}
+
+// TestSaveEpisodesSeenNotReissued tests that an episode we've already
+// stored isn't matched up with one that's left the feed, even if it looks
+// like a reissue of it.
+func TestSaveEpisodesSeenNotReissued(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+
+	podcast, err := app.podcasts.CreateFromFeed("Test Podcast", "https://example.com/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := func(guid, source string) FeedEpisode {
+		return FeedEpisode{
+			Title:       "Episode " + guid,
+			GUID:        guid,
+			PublishedOn: "Wed, 03 Jun 2020 11:00:00 +0000",
+			Source:      FeedSource{URL: source, Type: "audio/mpeg"},
+		}
+	}
+
+	_, err = app.saveEpisodes(podcast.ID, []FeedEpisode{
+		item("a", "https://example.com/a.mp3"),
+		item("b", "https://example.com/b.mp3"),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Episode b now has a's enclosure, and a has gone.
+	_, err = app.saveEpisodes(podcast.ID, []FeedEpisode{
+		item("b", "https://example.com/a.mp3"),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	episodes, err := app.episodes.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(episodes) != 2 {
+		t.Fatalf("want both episodes kept, got %d", len(episodes))
+	}
+
+	for _, ep := range episodes {
+		if removed := ep.RemovedAt != nil; removed != (ep.GUID == "a") {
+			t.Errorf("want only episode a removed, got %q removed: %t", ep.GUID, removed)
+		}
+	}
+
+	merges, err := app.episodes.Merges(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(merges) != 0 {
+		t.Errorf("want no merges, got %+v", merges)
+	}
+}
+
+// TestSaveEpisodesReissuedRollback tests that a reissued episode only
+// takes its new GUID if the rest of the feed is saved along with it.
+func TestSaveEpisodesReissuedRollback(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+
+	// With no workers, nothing is fetched in the background.
+	app.fetcher = &fetcher{Timeout: 5 * time.Second}
+
+	podcast, err := app.podcasts.CreateFromFeed("Test Podcast", "https://example.com/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := func(guid, title, source string) FeedEpisode {
+		return FeedEpisode{
+			Title:       title,
+			GUID:        guid,
+			PublishedOn: "Wed, 03 Jun 2020 11:00:00 +0000",
+			Source:      FeedSource{URL: source, Type: "audio/mpeg"},
+		}
+	}
+
+	_, err = app.saveEpisodes(podcast.ID, []FeedEpisode{
+		item("a", "Episode A", "https://example.com/a.mp3"),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Episode a is reissued as a2, but the feed can't be saved.
+	reissued := []FeedEpisode{
+		item("a2", "Episode A (remastered)", "https://example.com/a.mp3"),
+		item("c", "Episode C", "https://example.com/c.mp3"),
+	}
+
+	err = app.episodes.DB.DropTable(&models.Chapter{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.saveEpisodes(podcast.ID, reissued, false)
+	if err == nil {
+		t.Fatal("want an error saving the feed, got none")
+	}
+
+	episodes, err := app.episodes.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(episodes) != 1 || episodes[0].GUID != "a" || episodes[0].Title != "Episode A" {
+		t.Errorf("want episode a left as it was, got %+v", episodes)
+	}
+
+	merges, err := app.episodes.Merges(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(merges) != 0 {
+		t.Errorf("want no merges, got %+v", merges)
+	}
+
+	// Once the feed can be saved, the reissue is merged along with it.
+	err = app.episodes.DB.AutoMigrate(&models.Chapter{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.saveEpisodes(podcast.ID, reissued, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := app.episodes.Get(episodes[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if saved.GUID != "a2" || saved.Title != "Episode A (remastered)" {
+		t.Errorf("want episode a reissued as a2, got %q %q", saved.GUID, saved.Title)
+	}
+
+	merges, err = app.episodes.Merges(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(merges) != 1 || merges[0].OldGUID != "a" || merges[0].NewGUID != "a2" {
+		t.Errorf("want a merged into a2, got %+v", merges)
+	}
+}
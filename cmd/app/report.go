@@ -0,0 +1,67 @@
+package main
+
+import "fmt"
+
+// itemProblem is something wrong with a single item in a feed.
+type itemProblem struct {
+	Title   string
+	GUID    string
+	Problem string
+}
+
+// String describes the problem along with the item it belongs to.
+func (p itemProblem) String() string {
+	name := p.Title
+	if name == "" {
+		name = p.GUID
+	}
+	if name == "" {
+		name = "untitled item"
+	}
+
+	return fmt.Sprintf("%q: %s", name, p.Problem)
+}
+
+// feedReport is what happened to each of a feed's items when we saved it.
+// Skipped items weren't saved at all. Degraded items were saved, but with
+// something we couldn't read from the feed filled in some other way.
+type feedReport struct {
+	Items     int
+	Saved     int
+	Unchanged int
+	Removed   int
+	Skipped   []itemProblem
+	Degraded  []itemProblem
+}
+
+// skip records an item we couldn't save.
+func (r *feedReport) skip(ep FeedEpisode, problem string) {
+	r.Skipped = append(r.Skipped, itemProblem{Title: ep.title(), GUID: ep.GUID, Problem: problem})
+}
+
+// degrade records an item we saved despite a problem with it.
+func (r *feedReport) degrade(ep FeedEpisode, problem string) {
+	r.Degraded = append(r.Degraded, itemProblem{Title: ep.title(), GUID: ep.GUID, Problem: problem})
+}
+
+// warnings lists the problems in the report, one per line, for storing
+// against the podcast.
+func (r *feedReport) warnings() []string {
+	var warnings []string
+
+	for _, p := range r.Skipped {
+		warnings = append(warnings, "skipped "+p.String())
+	}
+
+	for _, p := range r.Degraded {
+		warnings = append(warnings, "degraded "+p.String())
+	}
+
+	return warnings
+}
+
+// String summarises the report for the logs.
+func (r *feedReport) String() string {
+	return fmt.Sprintf("%d items: %d saved, %d unchanged, %d removed, %d skipped, %d degraded",
+		r.Items, r.Saved, r.Unchanged, r.Removed, len(r.Skipped), len(r.Degraded))
+}
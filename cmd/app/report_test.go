@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+// TestFeedReportWarnings tests that skipped and degraded items are listed
+// in a feed's report.
+func TestFeedReportWarnings(t *testing.T) {
+	var report feedReport
+
+	report.skip(FeedEpisode{}, "no guid, enclosure or title to identify it by")
+	report.degrade(FeedEpisode{Title: "Episode 1", Duration: "soon"}, "unrecognised duration \"soon\"")
+
+	want := []string{
+		"skipped \"untitled item\": no guid, enclosure or title to identify it by",
+		"degraded \"Episode 1\": unrecognised duration \"soon\"",
+	}
+
+	got := report.warnings()
+	if len(got) != len(want) {
+		t.Fatalf("want %d, got %d warnings", len(want), len(got))
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("want %q, got %q", want[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// revisionFields are the episode details we keep a history of, by column,
+// along with how each is described to people.
+var revisionFields = []struct {
+	Field string
+	Label string
+	Value func(ep models.Episode) string
+}{
+	{"title", "Title", func(ep models.Episode) string { return ep.Title }},
+	{"source", "Audio URL", func(ep models.Episode) string { return ep.Source }},
+	{"duration", "Duration", func(ep models.Episode) string { return strconv.Itoa(ep.Duration) }},
+	{"published_on", "Published", func(ep models.Episode) string { return ep.PublishedOn.UTC().Format(time.RFC3339) }},
+	{"episode_number", "Episode number", func(ep models.Episode) string { return strconv.Itoa(ep.EpisodeNumber) }},
+	{"season", "Season", func(ep models.Episode) string { return strconv.Itoa(ep.Season) }},
+	{"season_name", "Season name", func(ep models.Episode) string { return ep.SeasonName }},
+	{"episode_type", "Episode type", func(ep models.Episode) string { return ep.EpisodeType }},
+	{"explicit", "Explicit", func(ep models.Episode) string { return strconv.FormatBool(ep.Explicit) }},
+	{"image_url", "Image", func(ep models.Episode) string { return ep.ImageURL }},
+	{"summary", "Summary", func(ep models.Episode) string { return ep.Summary }},
+	{"description", "Description", func(ep models.Episode) string { return ep.Description }},
+	{"enclosure_length", "File size", func(ep models.Episode) string { return strconv.FormatInt(ep.EnclosureLength, 10) }},
+	{"enclosure_type", "File type", func(ep models.Episode) string { return ep.EnclosureType }},
+	{"chapters_url", "Chapters", func(ep models.Episode) string { return ep.ChaptersURL }},
+	{"chapters_type", "Chapters type", func(ep models.Episode) string { return ep.ChaptersType }},
+}
+
+// episodeRevisions lists the details of a stored episode that differ from
+// what we've just read from its feed. An episode being removed from the
+// feed or coming back isn't a change to its details, so isn't included.
+func episodeRevisions(stored, fetched models.Episode, at time.Time) []models.EpisodeRevision {
+	var revisions []models.EpisodeRevision
+
+	for _, f := range revisionFields {
+		before, after := f.Value(stored), f.Value(fetched)
+		if before == after {
+			continue
+		}
+
+		revisions = append(revisions, models.EpisodeRevision{
+			PodcastID: stored.PodcastID,
+			EpisodeID: stored.ID,
+			Field:     f.Field,
+			OldValue:  before,
+			NewValue:  after,
+			ChangedAt: at,
+		})
+	}
+
+	return revisions
+}
+
+// groupRevisions puts together the changes to an episode that were made
+// at the same time, keeping them in order.
+func groupRevisions(revisions []models.EpisodeRevision) []TemplateRevision {
+	var groups []TemplateRevision
+
+	for _, r := range revisions {
+		if n := len(groups); n > 0 && groups[n-1].ChangedAt.Equal(r.ChangedAt) {
+			groups[n-1].Changes = append(groups[n-1].Changes, r)
+			continue
+		}
+
+		groups = append(groups, TemplateRevision{
+			ChangedAt: r.ChangedAt,
+			Changes:   []models.EpisodeRevision{r},
+		})
+	}
+
+	return groups
+}
+
+// revisionField describes a changed field for people.
+func revisionField(field string) string {
+	for _, f := range revisionFields {
+		if f.Field == field {
+			return f.Label
+		}
+	}
+
+	return field
+}
+
+// revisionValue formats one side of a change for people.
+func revisionValue(field, value string) string {
+	switch field {
+	case "duration":
+		secs, err := strconv.Atoi(value)
+		if err != nil {
+			return value
+		}
+
+		if secs == 0 {
+			return "unknown"
+		}
+
+		return timestamp(float64(secs))
+	case "published_on":
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return value
+		}
+
+		return humanDate(t)
+	case "description":
+		return stripTags(value)
+	default:
+		return value
+	}
+}
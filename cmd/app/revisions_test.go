@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// TestEpisodeRevisions tests that we record each detail of an episode
+// that's changed in its feed, with what it was before.
+func TestEpisodeRevisions(t *testing.T) {
+	published := time.Date(2020, time.June, 1, 9, 0, 0, 0, time.UTC)
+	now := time.Date(2020, time.June, 2, 9, 0, 0, 0, time.UTC)
+
+	stored := models.Episode{
+		ID:          3,
+		PodcastID:   7,
+		Title:       "Episode 1: The Begining",
+		Source:      "https://example.com/1.mp3",
+		Duration:    1800,
+		PublishedOn: published,
+		RemovedAt:   &published,
+	}
+
+	fetched := stored
+	fetched.ID = 0
+	fetched.RemovedAt = nil
+	fetched.Title = "Episode 1: The Beginning"
+	fetched.Source = "https://example.com/1-reupload.mp3"
+	fetched.Duration = 1830
+
+	got := episodeRevisions(stored, fetched, now)
+	want := []models.EpisodeRevision{
+		{PodcastID: 7, EpisodeID: 3, Field: "title", OldValue: "Episode 1: The Begining", NewValue: "Episode 1: The Beginning", ChangedAt: now},
+		{PodcastID: 7, EpisodeID: 3, Field: "source", OldValue: "https://example.com/1.mp3", NewValue: "https://example.com/1-reupload.mp3", ChangedAt: now},
+		{PodcastID: 7, EpisodeID: 3, Field: "duration", OldValue: "1800", NewValue: "1830", ChangedAt: now},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+
+	if revisions := episodeRevisions(stored, stored, now); len(revisions) != 0 {
+		t.Errorf("want no revisions, got %+v", revisions)
+	}
+}
+
+// TestSaveRevisions tests that every change to every episode in a feed is
+// saved.
+func TestSaveRevisions(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+
+	podcast, err := app.podcasts.CreateFromFeed("Test Podcast", "https://example.com/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 20
+
+	feed, err := decodeFeed("application/rss+xml", strings.NewReader(rssFixture(count)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.saveEpisodes(podcast.ID, feed.Channel.Items, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range feed.Channel.Items {
+		feed.Channel.Items[i].Title += " (remastered)"
+		feed.Channel.Items[i].Duration = "01:00:00"
+	}
+
+	_, err = app.saveEpisodes(podcast.ID, feed.Channel.Items, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	episodes, err := app.episodes.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(episodes) != count {
+		t.Fatalf("want %d episodes, got %d", count, len(episodes))
+	}
+
+	for _, ep := range episodes {
+		revisions, err := app.episodes.Revisions(ep.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(revisions) != 2 {
+			t.Errorf("want %d revisions for %q, got %+v", 2, ep.Title, revisions)
+		}
+	}
+}
+
+// TestGroupRevisions tests that changes made at the same time are shown
+// together.
+func TestGroupRevisions(t *testing.T) {
+	first := time.Date(2020, time.June, 1, 9, 0, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+
+	groups := groupRevisions([]models.EpisodeRevision{
+		{Field: "title", ChangedAt: second},
+		{Field: "duration", ChangedAt: second},
+		{Field: "title", ChangedAt: first},
+	})
+
+	if len(groups) != 2 {
+		t.Fatalf("want %d, got %d groups", 2, len(groups))
+	}
+
+	if len(groups[0].Changes) != 2 || !groups[0].ChangedAt.Equal(second) {
+		t.Errorf("want 2 changes at %s, got %+v", second, groups[0])
+	}
+
+	if len(groups[1].Changes) != 1 || !groups[1].ChangedAt.Equal(first) {
+		t.Errorf("want 1 change at %s, got %+v", first, groups[1])
+	}
+}
+
+// TestRevisionValue tests that changed values are shown the way the rest
+// of the app shows them.
+func TestRevisionValue(t *testing.T) {
+	tests := []struct {
+		field string
+		value string
+		want  string
+	}{
+		{"duration", "3723", "1:02:03"},
+		{"duration", "0", "unknown"},
+		{"published_on", "2020-06-01T09:00:00Z", "01 Jun 2020 at 09:00"},
+		{"description", "<p>Show <b>notes</b></p>", "Show notes"},
+		{"title", "A title", "A title"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			got := revisionValue(tt.field, tt.value)
+			if got != tt.want {
+				t.Errorf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -31,6 +31,7 @@ func (app *application) routes() http.Handler {
 	mux.Get("/podcasts/:collectionID", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.podcastPage)))
 
 	// Episode routes.
+	mux.Get("/episodes/:id/history", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.episodeHistory)))
 	mux.Post("/episodes/:id/listens", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.listen)))
 	mux.Post("/episodes/:id/listens/delete", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.unlisten)))
 	mux.Post("/api/episodes/:id/listens", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.apiListen)))
@@ -38,10 +39,21 @@ func (app *application) routes() http.Handler {
 
 	// Subscription routes.
 	mux.Post("/subscriptions", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.subscribe)))
+	mux.Get("/subscriptions/feed", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.addFeedPage)))
+	mux.Post("/subscriptions/feed", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.subscribeFeed)))
+	mux.Get("/subscriptions/import", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.importPage)))
+	mux.Post("/subscriptions/import", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.importSubscriptions)))
+	mux.Get("/subscriptions/export", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.exportSubscriptions)))
 	mux.Post("/subscriptions/delete", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.unsubscribe)))
 	mux.Post("/api/subscriptions", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.apiSubscribe)))
+	mux.Post("/api/subscriptions/feed", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.apiSubscribeFeed)))
+	mux.Post("/api/subscriptions/import", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.apiImportSubscriptions)))
 	mux.Post("/api/subscriptions/delete", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(http.HandlerFunc(app.apiUnsubscribe)))
 
+	// WebSub callbacks, which hubs call rather than users.
+	mux.Get("/websub/:id", http.HandlerFunc(app.websubVerify))
+	mux.Post("/websub/:id", http.HandlerFunc(app.websubNotify))
+
 	mux.Get("/ping", http.HandlerFunc(ping))
 
 	fileServer := http.FileServer(http.Dir("./static/"))
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+const (
+	// minRefreshInterval and maxRefreshInterval bound how often we'll
+	// refresh any one podcast.
+	minRefreshInterval = 30 * time.Minute
+	maxRefreshInterval = 24 * time.Hour
+
+	// defaultRefreshInterval is used for podcasts we don't have enough
+	// episodes for to work out how often they're released.
+	defaultRefreshInterval = 6 * time.Hour
+
+	// cadenceSample is how many recent episodes we look at to work out a
+	// podcast's release cadence.
+	cadenceSample = 10
+
+	// dueBatchSize is the most podcasts we'll refresh in one tick.
+	dueBatchSize = 50
+
+	// maxBackoff is the longest we'll wait before trying a failing feed
+	// again.
+	maxBackoff = 7 * 24 * time.Hour
+)
+
+// jitter spreads refreshes out a little so podcasts scheduled at the same
+// time don't all get fetched together.
+var jitter = struct {
+	sync.Mutex
+	rand *rand.Rand
+}{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// jittered adds up to a tenth of d to d, at random.
+func jittered(d time.Duration) time.Duration {
+	jitter.Lock()
+	defer jitter.Unlock()
+
+	return d + time.Duration(jitter.rand.Int63n(int64(d)/10+1))
+}
+
+// spread picks a random time within d of now, so podcasts we've never
+// scheduled get fetched gradually rather than all at once.
+func spread(d time.Duration) time.Duration {
+	jitter.Lock()
+	defer jitter.Unlock()
+
+	return time.Duration(jitter.rand.Int63n(int64(d) + 1))
+}
+
+// refreshInterval works out how long to wait before refreshing a podcast
+// again, given the publish dates of its most recent episodes. We check
+// about four times per typical gap between episodes, so a weekly show is
+// refreshed every day or so and a daily show every few hours. Shows that
+// have gone quiet for much longer than usual are checked the least often.
+func refreshInterval(dates []time.Time, now time.Time) time.Duration {
+	if len(dates) < 2 {
+		return defaultRefreshInterval
+	}
+
+	sorted := make([]time.Time, len(dates))
+	copy(sorted, dates)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].After(sorted[j]) })
+
+	var gaps []time.Duration
+	for i := 1; i < len(sorted); i++ {
+		gaps = append(gaps, sorted[i-1].Sub(sorted[i]))
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+
+	median := gaps[len(gaps)/2]
+	if median <= 0 {
+		return minRefreshInterval
+	}
+
+	// Dormant shows might come back, but there's no hurry.
+	if now.Sub(sorted[0]) > 4*median {
+		return maxRefreshInterval
+	}
+
+	interval := median / 4
+	if interval < minRefreshInterval {
+		return minRefreshInterval
+	}
+	if interval > maxRefreshInterval {
+		return maxRefreshInterval
+	}
+
+	return interval
+}
+
+// backoff works out how long to wait before trying a failing feed again.
+// The wait doubles with each failure in a row, starting from the shortest
+// refresh interval.
+func backoff(failures int) time.Duration {
+	wait := minRefreshInterval
+	for i := 1; i < failures && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+
+	return wait
+}
+
+// scheduleNextFetch works out when to next refresh a podcast, based on its
+// release cadence, and saves it. Feeds that are failing are backed off, but
+// never refreshed more often than their cadence would have them, and feeds
+// that are pushed to us are hardly polled at all.
+func (app *application) scheduleNextFetch(collectionID int) error {
+	podcast, err := app.podcasts.Get(collectionID)
+	if err != nil {
+		return err
+	}
+
+	dates, err := app.episodes.RecentPublishDates(collectionID, cadenceSample)
+	if err != nil {
+		return err
+	}
+
+	interval := refreshInterval(dates, time.Now())
+
+	// Feeds a hub is pushing to us only need the occasional check, in case
+	// the hub misses something.
+	if leaseActive(podcast, time.Now()) {
+		interval = maxRefreshInterval
+	}
+
+	if podcast.ConsecutiveFailures > 0 {
+		if wait := backoff(podcast.ConsecutiveFailures); wait > interval {
+			interval = wait
+		}
+	}
+
+	interval = jittered(interval)
+
+	return app.podcasts.ScheduleFetch(collectionID, time.Now().Add(interval))
+}
+
+// refreshAndSchedule refreshes a podcast and schedules its next refresh.
+// The next refresh is scheduled even if this one fails, so a broken feed
+// doesn't get retried on every tick.
+func (app *application) refreshAndSchedule(ctx context.Context, collectionID int) error {
+	refreshErr := app.refreshPodcast(ctx, collectionID)
+
+	err := app.scheduleNextFetch(collectionID)
+	if err != nil {
+		app.errorLog.Printf("scheduling podcast %d: %s", collectionID, err)
+	}
+
+	return refreshErr
+}
+
+// refreshDue refreshes every subscribed podcast that's due. Podcasts that
+// have never been scheduled, like those subscribed to before the scheduler
+// existed, are given a time spread over the default interval instead of
+// all being fetched at once.
+func (app *application) refreshDue() {
+	podcasts, err := app.podcasts.FindDue(time.Now(), dueBatchSize)
+	if err != nil {
+		app.errorLog.Printf("finding podcasts to refresh: %s", err)
+		return
+	}
+
+	var due []models.Podcast
+	for _, podcast := range podcasts {
+		if podcast.NextFetchAt == nil {
+			err := app.podcasts.ScheduleFetch(podcast.ID, time.Now().Add(spread(defaultRefreshInterval)))
+			if err != nil {
+				app.errorLog.Printf("scheduling podcast %d: %s", podcast.ID, err)
+			}
+			continue
+		}
+
+		due = append(due, podcast)
+	}
+
+	for _, result := range app.fetcher.run(context.Background(), due, app.refreshAndSchedule) {
+		if result.Err != nil {
+			app.errorLog.Printf("refreshing podcast %d: %s", result.Podcast.ID, result.Err)
+		}
+	}
+}
+
+// runScheduler refreshes due podcasts every so often, and renews any
+// WebSub leases that are running out, until the program exits.
+func (app *application) runScheduler(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		// Renewing leases means waiting on hubs, so it's done alongside the
+		// refreshes rather than holding them up, and cut off by the next
+		// tick so that renewals never pile up.
+		if app.websub != nil {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), every)
+				defer cancel()
+
+				app.renewLeases(ctx)
+			}()
+		}
+
+		app.refreshDue()
+		<-ticker.C
+	}
+}
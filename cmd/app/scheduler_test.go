@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestRefreshInterval tests that podcasts are refreshed in line with how
+// often they release episodes.
+func TestRefreshInterval(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	every := func(gap time.Duration, n int, last time.Time) []time.Time {
+		var dates []time.Time
+		for i := 0; i < n; i++ {
+			dates = append(dates, last.Add(-time.Duration(i)*gap))
+		}
+		return dates
+	}
+
+	tests := []struct {
+		name  string
+		dates []time.Time
+		want  time.Duration
+	}{
+		{"No episodes", nil, defaultRefreshInterval},
+		{"One episode", []time.Time{now.Add(-time.Hour)}, defaultRefreshInterval},
+		{"Weekly", every(7*24*time.Hour, 10, now.Add(-24*time.Hour)), maxRefreshInterval},
+		{"Twice weekly", every(84*time.Hour, 10, now.Add(-time.Hour)), 21 * time.Hour},
+		{"Daily", every(24*time.Hour, 10, now.Add(-time.Hour)), 6 * time.Hour},
+		{"Hourly", every(time.Hour, 10, now.Add(-time.Minute)), minRefreshInterval},
+		{"Dormant daily show", every(24*time.Hour, 10, now.Add(-30*24*time.Hour)), maxRefreshInterval},
+		{"Same time", []time.Time{now, now, now}, minRefreshInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := refreshInterval(tt.dates, now)
+			if got != tt.want {
+				t.Errorf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestBackoff tests that failing feeds are tried less and less often.
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 30 * time.Minute},
+		{2, time.Hour},
+		{3, 2 * time.Hour},
+		{6, 16 * time.Hour},
+		{9, 128 * time.Hour},
+		{10, maxBackoff},
+		{1000, maxBackoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d failures", tt.failures), func(t *testing.T) {
+			got := backoff(tt.failures)
+			if got != tt.want {
+				t.Errorf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
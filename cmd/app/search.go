@@ -17,11 +17,14 @@ type ITunesResult struct {
 }
 
 // Result corresponds to a single result from the iTunes search API.
+// PodcastID is our ID for the podcast, which is filled in once the result
+// has been saved.
 type Result struct {
 	CollectionID   int
 	CollectionName string
 	FeedURL        string
 	ArtworkURL30   string
+	PodcastID      int `json:"-"`
 }
 
 // getResults checks if a result exists in the redis cache. If it does, return
@@ -90,13 +93,16 @@ func (app *application) getResults(term string) (ITunesResult, error) {
 	return result, nil
 }
 
-// saveResults saves all podcasts in the results to the database.
+// saveResults saves all podcasts in the results to the database, and
+// fills in their podcast IDs.
 func (app *application) saveResults(rs []Result) error {
-	for _, r := range rs {
-		err := app.podcasts.Create(r.CollectionID, r.CollectionName, r.FeedURL)
+	for i, r := range rs {
+		podcast, err := app.podcasts.CreateFromITunes(r.CollectionID, r.CollectionName, r.FeedURL)
 		if err != nil {
 			return err
 		}
+
+		rs[i].PodcastID = podcast.ID
 	}
 
 	return nil
@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"html"
 	"html/template"
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/charlesharries/podcast-stats/pkg/forms"
@@ -26,18 +28,35 @@ type TemplateSubscription struct {
 	CollectionID int
 	Name         string
 	Episodes     []TemplateEpisode
+	FailingSince *time.Time
 }
 
 // TemplateEpisode is a representation of a single podcast
 // episode passed into a template. We only need a subset of episode
 // data in our templates.
 type TemplateEpisode struct {
-	ID           uint
-	Title        string
-	Duration     int
-	PublishedOn  time.Time
-	Listened     bool
-	CollectionID int
+	ID            uint
+	Title         string
+	Duration      int
+	PublishedOn   time.Time
+	Listened      bool
+	CollectionID  int
+	EpisodeNumber int
+	Season        int
+	EpisodeType   string
+	ImageURL      string
+	Notes         string
+	Chapters      []models.Chapter
+	Transcript    string
+	Removed       bool
+	Revisions     int
+}
+
+// TemplateRevision is a set of changes to an episode that we found in
+// its feed at the same time.
+type TemplateRevision struct {
+	ChangedAt time.Time
+	Changes   []models.EpisodeRevision
 }
 
 // TemplateStats are general global stats about all of your podcasts.
@@ -63,11 +82,17 @@ type templateData struct {
 	CurrentYear   int
 	CurrentMonth  time.Month
 	Flash         string
+	Episode       models.Episode
 	Episodes      []TemplateEpisode
+	EpisodeMerges []models.EpisodeMerge
 	EpisodesByDay map[string][]TemplateEpisode
+	FeedMoves     []models.FeedMove
 	Form          *forms.Form
+	Guests        []models.PersonListens
+	Imports       []importResult
 	Podcast       models.Podcast
 	Results       ITunesResult
+	Revisions     []TemplateRevision
 	Search        string
 	SearchForm    *forms.Form
 	Stats         TemplateStats
@@ -107,11 +132,12 @@ func hasSubscription(ss []TemplateSubscription, id int) bool {
 	return false
 }
 
-// countUnlistened gets the number of unlistened-to episodes.
+// countUnlistened gets the number of unlistened-to episodes. Episodes
+// that have been removed from their feed don't count.
 func countUnlistened(eps []TemplateEpisode) int {
 	count := 0
 	for _, ep := range eps {
-		if !ep.Listened {
+		if !ep.Listened && !ep.Removed {
 			count++
 		}
 	}
@@ -137,12 +163,27 @@ func humanSeconds(secs int) string {
 	return hs + ms
 }
 
-// unlistenedTime get the amount of unlistened-to podcast time.
+// timestamp formats a position within an episode, like "1:02:03".
+func timestamp(secs float64) string {
+	s := int(secs)
+	h := s / (60 * 60)
+	m := (s - (h * 60 * 60)) / 60
+	s = s % 60
+
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// unlistenedTime get the amount of unlistened-to podcast time. Episodes
+// that have been removed from their feed don't count.
 func unlistenedTime(eps []TemplateEpisode) int {
 	seconds := 0
 
 	for _, ep := range eps {
-		if !ep.Listened {
+		if !ep.Listened && !ep.Removed {
 			seconds += ep.Duration
 		}
 	}
@@ -150,6 +191,37 @@ func unlistenedTime(eps []TemplateEpisode) int {
 	return seconds
 }
 
+// episodeNotes gets the plain-text show notes for an episode, preferring
+// the iTunes summary and falling back to the HTML description.
+func episodeNotes(ep models.Episode) string {
+	if ep.Summary != "" {
+		return ep.Summary
+	}
+
+	return stripTags(ep.Description)
+}
+
+// stripTags removes HTML tags and entities from a string so it can be
+// shown as plain text.
+func stripTags(s string) string {
+	var b strings.Builder
+	inTag := false
+
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>' && inTag:
+			inTag = false
+			b.WriteRune(' ')
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+
+	return strings.Join(strings.Fields(html.UnescapeString(b.String())), " ")
+}
+
 func daysOfTheMonth(year int, month time.Month) []time.Time {
 	t := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
 	var days []time.Time
@@ -256,10 +328,15 @@ var functions = template.FuncMap{
 	"sortByPublishedOn": sortByPublishedOn,
 	"unlistenedTime":    unlistenedTime,
 	"humanSeconds":      humanSeconds,
+	"timestamp":         timestamp,
+	"stripTags":         stripTags,
 	"iterate":           iterate,
 	"daysOfTheMonth":    daysOfTheMonth,
 	"episodesOnDate":    episodesOnDate,
 	"episodesFromSubs":  episodesFromSubs,
+	"importSummary":     importSummary,
+	"revisionField":     revisionField,
+	"revisionValue":     revisionValue,
 }
 
 // newTemplateCache pre-compiles all of our templates so we're not re-compiling
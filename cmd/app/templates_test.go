@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestUnlistenedStats tests that the unlistened stats leave out episodes
+// that have been listened to or removed from their feed.
+func TestUnlistenedStats(t *testing.T) {
+	eps := []TemplateEpisode{
+		{ID: 1, Duration: 60},
+		{ID: 2, Duration: 120, Listened: true},
+		{ID: 3, Duration: 240, Removed: true},
+		{ID: 4, Duration: 480, Listened: true, Removed: true},
+	}
+
+	if got := countUnlistened(eps); got != 1 {
+		t.Errorf("want %d unlistened episodes, got %d", 1, got)
+	}
+
+	if got := unlistenedTime(eps); got != 60 {
+		t.Errorf("want %d seconds unlistened, got %d", 60, got)
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/charlesharries/podcast-stats/pkg/models"
 	"github.com/golangcollege/sessions"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
 // newTestApplication generates a dummy application struct
@@ -25,6 +30,61 @@ func newTestApplication(t *testing.T) *application {
 	}
 }
 
+// newTestDB opens an empty in-memory SQLite database with all of our
+// tables, for tests which need to save things. Every connection to an
+// in-memory database gets a database of its own, so only one is opened.
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	err = db.AutoMigrate(
+		&models.Chapter{},
+		&models.Episode{},
+		&models.EpisodeMerge{},
+		&models.EpisodeRevision{},
+		&models.FeedMove{},
+		&models.Listen{},
+		&models.Person{},
+		&models.Podcast{},
+		&models.Subscription{},
+		&models.Transcript{},
+		&models.User{},
+	).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// newTestFetcher makes a fetcher small enough to use in tests.
+func newTestFetcher() *fetcher {
+	return &fetcher{Workers: 2, PerHost: 2, Timeout: 5 * time.Second}
+}
+
+// newTestApplicationWithDB generates a dummy application struct like
+// newTestApplication, but with models backed by a test database.
+func newTestApplicationWithDB(t *testing.T) *application {
+	app := newTestApplication(t)
+	db := newTestDB(t)
+
+	app.chapters = &models.ChapterModel{DB: db}
+	app.episodes = &models.EpisodeModel{DB: db}
+	app.fetcher = newTestFetcher()
+	app.listens = &models.ListenModel{DB: db}
+	app.people = &models.PersonModel{DB: db}
+	app.podcasts = &models.PodcastModel{DB: db}
+	app.subscriptions = &models.SubscriptionModel{DB: db}
+	app.transcripts = &models.TranscriptModel{DB: db}
+	app.users = &models.UserModel{DB: db}
+
+	return app
+}
+
 // testServer embeds an httptest.Server instance to allow us to
 // get and post to our handlers.
 type testServer struct {
@@ -65,3 +125,36 @@ func (ts *testServer) get(t *testing.T, urlPath string) (int, http.Header, []byt
 
 	return rs.StatusCode, rs.Header, body
 }
+
+// rssFixture generates an RSS feed with the given number of episodes,
+// newest first, one day apart.
+func rssFixture(count int) string {
+	var b strings.Builder
+
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	b.WriteString(`<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel>`)
+	b.WriteString(`<title>Test Podcast</title>`)
+
+	start := time.Date(2020, time.June, 1, 9, 0, 0, 0, time.UTC)
+	for i := count; i > 0; i-- {
+		fmt.Fprintf(&b, `<item>
+			<title>Episode %d</title>
+			<guid>test-episode-%d</guid>
+			<pubDate>%s</pubDate>
+			<enclosure url="https://example.com/episodes/%d.mp3" type="audio/mpeg"/>
+			<itunes:duration>00:%02d:30</itunes:duration>
+		</item>`, i, i, start.AddDate(0, 0, i).Format(time.RFC1123Z), i, i%60)
+	}
+
+	b.WriteString(`</channel></rss>`)
+
+	return b.String()
+}
+
+// newTestFeedServer serves the given feed body at every path.
+func newTestFeedServer(t *testing.T, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Write([]byte(body))
+	}))
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// websub subscribes to WebSub (https://www.w3.org/TR/websub/) hubs, so
+// feeds that have one are pushed to us as soon as they change rather than
+// us having to poll them. CallbackURL is the public address of the app,
+// which hubs call back to. We ask for leases of Lease, and renew them
+// RenewBefore they run out.
+type websub struct {
+	CallbackURL string
+	Lease       time.Duration
+	RenewBefore time.Duration
+	Timeout     time.Duration
+}
+
+const (
+	// leaseBatchSize is the most leases we renew on each tick of the
+	// scheduler.
+	leaseBatchSize = 50
+
+	// maxRenewalFailures is how many times in a row we'll fail to renew a
+	// lease before giving up on the hub. The feed is polled as normal from
+	// then on, and we subscribe afresh if it still has a hub when we next
+	// fetch it.
+	maxRenewalFailures = 3
+
+	// websubVerifyWithin is how long a hub has to confirm a subscription
+	// we've asked for. Confirmations we aren't waiting for are turned away,
+	// so nobody else can extend or revive a lease.
+	websubVerifyWithin = time.Hour
+
+	// websubMaxLease is the longest lease we'll accept from a hub. Longer
+	// ones are cut short, and renewed like any other.
+	websubMaxLease = 30 * 24 * time.Hour
+)
+
+// linkHeader reads the rels and URLs out of HTTP Link headers, like
+// `<https://hub.example.com/>; rel="hub"`. Where there's more than one link
+// with a rel, the first is kept.
+func linkHeader(values []string) map[string]string {
+	links := map[string]string{}
+
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			target = strings.Trim(target, "<>")
+
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "rel") {
+					continue
+				}
+
+				for _, rel := range strings.Fields(strings.Trim(kv[1], `"`)) {
+					rel = strings.ToLower(rel)
+					if _, ok := links[rel]; !ok {
+						links[rel] = target
+					}
+				}
+			}
+		}
+	}
+
+	return links
+}
+
+// hubLinks finds the WebSub hub a feed is pushed from, and the topic URL
+// to subscribe to, from the feed's atom:link elements or failing that its
+// Link headers. The topic is the feed's own URL unless it says otherwise.
+func hubLinks(fetch feedFetch, feedURL string) (string, string) {
+	links := map[string]string{}
+	for _, l := range fetch.Feed.Channel.AtomLinks {
+		for _, rel := range strings.Fields(strings.ToLower(l.Rel)) {
+			if _, ok := links[rel]; !ok && strings.TrimSpace(l.Href) != "" {
+				links[rel] = strings.TrimSpace(l.Href)
+			}
+		}
+	}
+
+	if links["hub"] == "" {
+		links = fetch.Links
+	}
+
+	hub := links["hub"]
+	if hub == "" {
+		return "", ""
+	}
+
+	topic := links["self"]
+	if topic == "" {
+		topic = feedURL
+	}
+
+	return hub, topic
+}
+
+// newHubSecret makes a secret for a hub to sign what it sends us with.
+func newHubSecret() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// callback gets the URL a hub should call for a podcast.
+func (ws *websub) callback(podcastID int) string {
+	return fmt.Sprintf("%s/websub/%d", strings.TrimRight(ws.CallbackURL, "/"), podcastID)
+}
+
+// request asks a hub to subscribe or unsubscribe us from a topic. The hub
+// checks with us that we really asked before it does anything.
+func (ws *websub) request(ctx context.Context, mode, hub, topic string, podcastID int, secret string) error {
+	form := url.Values{}
+	form.Set("hub.mode", mode)
+	form.Set("hub.topic", topic)
+	form.Set("hub.callback", ws.callback(podcastID))
+
+	if mode == "subscribe" {
+		form.Set("hub.secret", secret)
+		form.Set("hub.lease_seconds", strconv.Itoa(int(ws.Lease.Seconds())))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ws.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(&limitedReader{r: resp.Body, n: 1024})
+		return fmt.Errorf("%s %s: %s: %s", mode, hub, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// verifyIntent checks a hub's request to confirm a subscription change
+// against what we asked for. If it's one we asked for, it returns the
+// challenge to echo back to the hub, and for subscriptions, how long the
+// hub has given us, up to websubMaxLease. Subscriptions are only confirmed
+// within websubVerifyWithin of us asking for them.
+func verifyIntent(podcast models.Podcast, q url.Values, now time.Time) (string, time.Duration, bool) {
+	challenge := q.Get("hub.challenge")
+	if challenge == "" {
+		return "", 0, false
+	}
+
+	subscribed := podcast.HubURL != "" && q.Get("hub.topic") == podcast.HubTopic
+
+	switch q.Get("hub.mode") {
+	case "subscribe":
+		requested := podcast.HubRequestedAt != nil && now.Before(podcast.HubRequestedAt.Add(websubVerifyWithin))
+		if !subscribed || !requested {
+			return "", 0, false
+		}
+
+		secs, err := strconv.ParseInt(q.Get("hub.lease_seconds"), 10, 64)
+		if err != nil || secs <= 0 {
+			return "", 0, false
+		}
+
+		lease := websubMaxLease
+		if secs < int64(websubMaxLease/time.Second) {
+			lease = time.Duration(secs) * time.Second
+		}
+
+		return challenge, lease, true
+	case "unsubscribe":
+		return challenge, 0, !subscribed
+	default:
+		return "", 0, false
+	}
+}
+
+// signatureHashes are the hash functions a hub can sign with.
+var signatureHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// validSignature checks the X-Hub-Signature a hub sent along with some
+// content, like "sha256=...", against the secret we gave it.
+func validSignature(secret, signature string, body []byte) bool {
+	parts := strings.SplitN(signature, "=", 2)
+	if secret == "" || len(parts) != 2 {
+		return false
+	}
+
+	newHash, ok := signatureHashes[strings.ToLower(parts[0])]
+	if !ok {
+		return false
+	}
+
+	want, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// leaseActive checks whether a hub is currently pushing a podcast to us.
+func leaseActive(podcast models.Podcast, now time.Time) bool {
+	return podcast.HubURL != "" && podcast.HubLeaseExpiresAt != nil && podcast.HubLeaseExpiresAt.After(now)
+}
+
+// updateHub makes sure we're subscribed to the hub a podcast's feed is
+// pushed from. If the feed has moved to a new hub or topic, we subscribe
+// afresh, and if it no longer has a hub, we unsubscribe from the old one.
+// Nothing happens unless WebSub is turned on.
+func (app *application) updateHub(ctx context.Context, podcast models.Podcast, hub, topic string) error {
+	if app.websub == nil {
+		return nil
+	}
+
+	if hub == "" {
+		if podcast.HubURL == "" {
+			return nil
+		}
+
+		err := app.podcasts.ClearHub(podcast.ID)
+		if err != nil {
+			return err
+		}
+
+		return app.websub.request(ctx, "unsubscribe", podcast.HubURL, podcast.HubTopic, podcast.ID, "")
+	}
+
+	if podcast.HubURL == hub && podcast.HubTopic == topic && leaseActive(podcast, time.Now().Add(app.websub.RenewBefore)) {
+		return nil
+	}
+
+	return app.subscribeHub(ctx, podcast, hub, topic)
+}
+
+// subscribeHub asks a hub to push a podcast's feed to us. We keep the
+// secret we already have with the hub, so that anything it sends before
+// confirming the renewal can still be checked. The request is marked as
+// waiting for confirmation before it's sent, since hubs can confirm it
+// before they've answered.
+func (app *application) subscribeHub(ctx context.Context, podcast models.Podcast, hub, topic string) error {
+	secret := podcast.HubSecret
+	if podcast.HubURL != hub || secret == "" {
+		var err error
+
+		secret, err = newHubSecret()
+		if err != nil {
+			return err
+		}
+	}
+
+	if podcast.HubURL != hub || podcast.HubTopic != topic || podcast.HubSecret != secret {
+		err := app.podcasts.SetHub(podcast.ID, hub, topic, secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := app.podcasts.RequestHub(podcast.ID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("subscribing podcast %d to %s at %s", podcast.ID, topic, hub)
+
+	return app.websub.request(ctx, "subscribe", hub, topic, podcast.ID, secret)
+}
+
+// renewLeases resubscribes to hubs whose leases are about to run out, or
+// ran out recently, until they're all done or ctx is. Leases that ran out
+// longer ago than we'd have started renewing them are left alone, and so
+// are hubs we've given up on, so they can't crowd out the leases that are
+// still live.
+func (app *application) renewLeases(ctx context.Context) {
+	now := time.Now()
+
+	podcasts, err := app.podcasts.FindExpiringLeases(now.Add(-app.websub.RenewBefore), now.Add(app.websub.RenewBefore), leaseBatchSize)
+	if err != nil {
+		app.errorLog.Printf("finding leases to renew: %s", err)
+		return
+	}
+
+	for _, podcast := range podcasts {
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := app.subscribeHub(ctx, podcast, podcast.HubURL, podcast.HubTopic)
+		if err == nil {
+			continue
+		}
+
+		app.errorLog.Printf("renewing podcast %d's lease at %s: %s", podcast.ID, podcast.HubURL, err)
+
+		if podcast.HubRenewalFailures+1 >= maxRenewalFailures {
+			app.infoLog.Printf("warning: giving up on %s for podcast %d", podcast.HubURL, podcast.ID)
+			err = app.podcasts.ClearHub(podcast.ID)
+		} else {
+			err = app.podcasts.FailHubRenewal(podcast.ID)
+		}
+		if err != nil {
+			app.errorLog.Printf("recording podcast %d's lease renewal: %s", podcast.ID, err)
+		}
+	}
+}
+
+// ingestPush saves the episodes a hub has pushed to us. Hubs can push
+// just the entries that are new rather than the whole feed, so what's
+// pushed is only ever added to what we have: nothing is marked as removed,
+// and the podcast's details and validators are left for the next time we
+// fetch the feed ourselves.
+func (app *application) ingestPush(podcast models.Podcast, contentType string, body []byte) error {
+	feed, err := decodeFeed(contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	report, err := app.saveEpisodes(podcast.ID, feed.Channel.Items, true)
+	if err != nil {
+		return err
+	}
+
+	app.logReport(podcast.ID, report)
+
+	return app.scheduleNextFetch(podcast.ID)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charlesharries/podcast-stats/pkg/models"
+)
+
+// TestHubLinks tests that we find a feed's hub in its atom:link elements,
+// or failing that in its Link headers.
+func TestHubLinks(t *testing.T) {
+	rss := `<rss xmlns:atom="http://www.w3.org/2005/Atom"><channel>
+		<title>Pushed</title>
+		<atom:link rel="hub" href="https://hub.example.com/"/>
+		<atom:link rel="self" href="https://example.com/canonical.xml"/>
+		<link>https://example.com/</link>
+	</channel></rss>`
+
+	tests := []struct {
+		name      string
+		body      string
+		links     map[string]string
+		wantHub   string
+		wantTopic string
+	}{
+		{"atom:link", rss, nil, "https://hub.example.com/", "https://example.com/canonical.xml"},
+		{"Link header", rssFixture(1), linkHeader([]string{`<https://hub.example.com/>; rel="hub"`}), "https://hub.example.com/", "https://example.com/feed.xml"},
+		{"No hub", rssFixture(1), nil, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feed, err := decodeFeed("application/rss+xml", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hub, topic := hubLinks(feedFetch{Feed: feed, Links: tt.links}, "https://example.com/feed.xml")
+			if hub != tt.wantHub || topic != tt.wantTopic {
+				t.Errorf("want %q and %q, got %q and %q", tt.wantHub, tt.wantTopic, hub, topic)
+			}
+
+			if tt.name == "atom:link" && feed.Channel.Link != "https://example.com/" {
+				t.Errorf("want link %q, got %q", "https://example.com/", feed.Channel.Link)
+			}
+		})
+	}
+}
+
+// TestLinkHeader tests that we can read the different ways Link headers
+// are written.
+func TestLinkHeader(t *testing.T) {
+	got := linkHeader([]string{
+		`<https://hub.example.com/>; rel="hub", <https://example.com/feed.xml>; rel=self`,
+		`<https://other-hub.example.com/>; rel="hub alternate"`,
+	})
+
+	want := map[string]string{
+		"hub":       "https://hub.example.com/",
+		"self":      "https://example.com/feed.xml",
+		"alternate": "https://other-hub.example.com/",
+	}
+
+	for rel, href := range want {
+		if got[rel] != href {
+			t.Errorf("want %s %q, got %q", rel, href, got[rel])
+		}
+	}
+}
+
+// TestVerifyIntent tests that we only confirm the subscription changes we
+// asked for, while we're waiting for them.
+func TestVerifyIntent(t *testing.T) {
+	now := time.Now()
+	requested := now.Add(-time.Minute)
+	stale := now.Add(-2 * websubVerifyWithin)
+
+	subscribed := models.Podcast{HubURL: "https://hub.example.com/", HubTopic: "https://example.com/feed.xml", HubRequestedAt: &requested}
+	confirmed := models.Podcast{HubURL: "https://hub.example.com/", HubTopic: "https://example.com/feed.xml"}
+	expired := models.Podcast{HubURL: "https://hub.example.com/", HubTopic: "https://example.com/feed.xml", HubRequestedAt: &stale}
+
+	tests := []struct {
+		name      string
+		podcast   models.Podcast
+		query     string
+		wantOK    bool
+		wantLease time.Duration
+	}{
+		{"Subscribe", subscribed, "hub.mode=subscribe&hub.topic=https://example.com/feed.xml&hub.challenge=abc&hub.lease_seconds=3600", true, time.Hour},
+		{"Other topic", subscribed, "hub.mode=subscribe&hub.topic=https://example.com/other.xml&hub.challenge=abc&hub.lease_seconds=3600", false, 0},
+		{"No lease", subscribed, "hub.mode=subscribe&hub.topic=https://example.com/feed.xml&hub.challenge=abc", false, 0},
+		{"No challenge", subscribed, "hub.mode=subscribe&hub.topic=https://example.com/feed.xml&hub.lease_seconds=3600", false, 0},
+		{"Not asked for", models.Podcast{}, "hub.mode=subscribe&hub.topic=https://example.com/feed.xml&hub.challenge=abc&hub.lease_seconds=3600", false, 0},
+		{"Already confirmed", confirmed, "hub.mode=subscribe&hub.topic=https://example.com/feed.xml&hub.challenge=abc&hub.lease_seconds=3600", false, 0},
+		{"Asked for too long ago", expired, "hub.mode=subscribe&hub.topic=https://example.com/feed.xml&hub.challenge=abc&hub.lease_seconds=3600", false, 0},
+		{"Huge lease", subscribed, "hub.mode=subscribe&hub.topic=https://example.com/feed.xml&hub.challenge=abc&hub.lease_seconds=9223372036854775807", true, websubMaxLease},
+		{"Unsubscribe", models.Podcast{}, "hub.mode=unsubscribe&hub.topic=https://example.com/feed.xml&hub.challenge=abc", true, 0},
+		{"Unsubscribe while subscribed", confirmed, "hub.mode=unsubscribe&hub.topic=https://example.com/feed.xml&hub.challenge=abc", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			challenge, lease, ok := verifyIntent(tt.podcast, q, now)
+			if ok != tt.wantOK {
+				t.Fatalf("want %t, got %t", tt.wantOK, ok)
+			}
+
+			if ok && challenge != "abc" {
+				t.Errorf("want %q, got %q", "abc", challenge)
+			}
+
+			if lease != tt.wantLease {
+				t.Errorf("want %s, got %s", tt.wantLease, lease)
+			}
+		})
+	}
+}
+
+// sign signs a body the way a hub does.
+func sign(method string, secret string, body []byte) string {
+	newHash := sha256.New
+	if method == "sha1" {
+		newHash = sha1.New
+	}
+
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+
+	return method + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// TestValidSignature tests that we only accept content signed with our
+// secret.
+func TestValidSignature(t *testing.T) {
+	body := []byte(rssFixture(1))
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		want      bool
+	}{
+		{"SHA-256", "secret", sign("sha256", "secret", body), true},
+		{"SHA-1", "secret", sign("sha1", "secret", body), true},
+		{"Wrong secret", "secret", sign("sha256", "other", body), false},
+		{"Unknown method", "secret", "md5=abc", false},
+		{"Not hex", "secret", "sha256=xyz", false},
+		{"Missing", "secret", "", false},
+		{"No secret", "", sign("sha256", "", body), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validSignature(tt.secret, tt.signature, body)
+			if got != tt.want {
+				t.Errorf("want %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestWebSubRoundTrip tests subscribing to a hub and receiving content
+// from it through our callback routes, against a stand-in hub which
+// verifies the subscription and then publishes to us, once not properly
+// signed and once properly signed.
+func TestWebSubRoundTrip(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	topic := "https://example.com/feed.xml"
+
+	podcast, err := app.podcasts.CreateFromFeed("Test Podcast", topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hub, which checks the subscription with us before accepting it,
+	// then publishes the topic.
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		if r.PostForm.Get("hub.mode") != "subscribe" || r.PostForm.Get("hub.topic") != topic {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		callback := r.PostForm.Get("hub.callback")
+		if want := ts.URL + "/websub/" + strconv.Itoa(podcast.ID); callback != want {
+			t.Errorf("want callback %q, got %q", want, callback)
+		}
+
+		verify := callback + "?" + url.Values{
+			"hub.mode":          {"subscribe"},
+			"hub.topic":         {topic},
+			"hub.challenge":     {"challenge-123"},
+			"hub.lease_seconds": {r.PostForm.Get("hub.lease_seconds")},
+		}.Encode()
+
+		resp, err := http.Get(verify)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		echoed, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(echoed) != "challenge-123" {
+			t.Errorf("want challenge echoed, got %q", echoed)
+			return
+		}
+
+		pushes := []struct {
+			key  string
+			body string
+		}{
+			{"not-the-secret", rssFixture(3)},
+			{r.PostForm.Get("hub.secret"), rssFixture(2)},
+		}
+
+		for _, push := range pushes {
+			req, _ := http.NewRequest("POST", callback, strings.NewReader(push.body))
+			req.Header.Set("Content-Type", "application/rss+xml")
+			req.Header.Set("X-Hub-Signature", sign("sha256", push.key, []byte(push.body)))
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusAccepted {
+				t.Errorf("want push acknowledged with %d, got %d", http.StatusAccepted, resp.StatusCode)
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hub.Close()
+
+	app.websub = &websub{CallbackURL: ts.URL + "/", Lease: time.Hour, RenewBefore: time.Minute, Timeout: 5 * time.Second}
+
+	err = app.subscribeHub(context.Background(), podcast, hub.URL, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribed, err := app.podcasts.Get(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subscribed.HubURL != hub.URL || subscribed.HubLeaseExpiresAt == nil {
+		t.Fatalf("want the subscription to %s confirmed, got %q until %v", hub.URL, subscribed.HubURL, subscribed.HubLeaseExpiresAt)
+	}
+
+	if until := time.Until(*subscribed.HubLeaseExpiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("want a lease of %s, got one running out in %s", time.Hour, until)
+	}
+
+	// Once it's confirmed, nobody else can confirm it again to extend it.
+	forged, err := http.Get(ts.URL + "/websub/" + strconv.Itoa(podcast.ID) + "?" + url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {topic},
+		"hub.challenge":     {"forged"},
+		"hub.lease_seconds": {"31536000"},
+	}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Body.Close()
+
+	if forged.StatusCode != http.StatusNotFound {
+		t.Errorf("want an unrequested confirmation turned away with %d, got %d", http.StatusNotFound, forged.StatusCode)
+	}
+
+	// Pushes are saved in the background, so give the signed one a moment.
+	var episodes []models.Episode
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		episodes, err = app.episodes.FindByPodcast(podcast.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(episodes) > 0 {
+			break
+		}
+	}
+
+	if len(episodes) != 2 {
+		t.Errorf("want only the signed push's %d episodes, got %d", 2, len(episodes))
+	}
+}
+
+// TestIngestPushPartial tests that a hub pushing only the new entries in
+// a feed adds them to the podcast without touching the episodes it
+// already has, or the feed's validators.
+func TestIngestPushPartial(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+
+	podcast, err := app.podcasts.CreateFromFeed("Test Podcast", "https://example.com/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed, err := decodeFeed("application/rss+xml", strings.NewReader(rssFixture(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.saveFeed(podcast, feedFetch{Feed: feed, Hash: "full-feed", Status: http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	push := `<?xml version="1.0" encoding="UTF-8"?>
+		<rss version="2.0"><channel><title>Test Podcast</title>
+		<item>
+			<title>Episode 4</title>
+			<guid>test-episode-4</guid>
+			<pubDate>Fri, 05 Jun 2020 09:00:00 +0000</pubDate>
+			<enclosure url="https://example.com/episodes/4.mp3" type="audio/mpeg"/>
+		</item>
+		</channel></rss>`
+
+	err = app.ingestPush(podcast, "application/rss+xml", []byte(push))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	episodes, err := app.episodes.FindByPodcast(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(episodes) != 4 {
+		t.Errorf("want %d episodes, got %d", 4, len(episodes))
+	}
+
+	for _, ep := range episodes {
+		if ep.RemovedAt != nil {
+			t.Errorf("want %q kept, got it marked removed", ep.Title)
+		}
+	}
+
+	saved, err := app.podcasts.Get(podcast.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if saved.FeedHash != "full-feed" {
+		t.Errorf("want feed hash %q, got %q", "full-feed", saved.FeedHash)
+	}
+}
+
+// TestRenewLeases tests that we renew leases that are running out, give
+// up on hubs that keep failing, and leave leases that ran out long ago
+// alone.
+func TestRenewLeases(t *testing.T) {
+	app := newTestApplicationWithDB(t)
+
+	var mu sync.Mutex
+	requests := map[string]int{}
+
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		mu.Lock()
+		requests[r.PostForm.Get("hub.topic")]++
+		mu.Unlock()
+
+		if r.URL.Path == "/dead" {
+			http.Error(w, "gone away", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hub.Close()
+
+	app.websub = &websub{CallbackURL: "https://podcasts.example.com/", Lease: time.Hour, RenewBefore: time.Hour, Timeout: time.Second}
+
+	leases := []struct {
+		topic     string
+		hub       string
+		expiresIn time.Duration
+	}{
+		{"https://example.com/live.xml", hub.URL + "/live", 30 * time.Minute},
+		{"https://example.com/dead.xml", hub.URL + "/dead", 30 * time.Minute},
+		{"https://example.com/expired.xml", hub.URL + "/live", -48 * time.Hour},
+	}
+
+	ids := map[string]int{}
+	for _, l := range leases {
+		podcast, err := app.podcasts.CreateFromFeed(l.topic, l.topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[l.topic] = podcast.ID
+
+		err = app.subscriptions.Create(podcast.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.podcasts.SetHub(podcast.ID, l.hub, l.topic, "s3cret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = app.podcasts.ConfirmHub(podcast.ID, time.Now().Add(l.expiresIn))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < maxRenewalFailures+1; i++ {
+		app.renewLeases(context.Background())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if n := requests["https://example.com/live.xml"]; n != maxRenewalFailures+1 {
+		t.Errorf("want the live lease renewed %d times, got %d", maxRenewalFailures+1, n)
+	}
+
+	if n := requests["https://example.com/dead.xml"]; n != maxRenewalFailures {
+		t.Errorf("want the dead hub tried %d times, got %d", maxRenewalFailures, n)
+	}
+
+	if n := requests["https://example.com/expired.xml"]; n != 0 {
+		t.Errorf("want the long expired lease left alone, got %d renewals", n)
+	}
+
+	dead, err := app.podcasts.Get(ids["https://example.com/dead.xml"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dead.HubURL != "" {
+		t.Errorf("want the dead hub forgotten, got %q", dead.HubURL)
+	}
+
+	live, err := app.podcasts.Get(ids["https://example.com/live.xml"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if live.HubURL == "" || live.HubRenewalFailures != 0 {
+		t.Errorf("want the live hub kept with no failures, got %q with %d", live.HubURL, live.HubRenewalFailures)
+	}
+}
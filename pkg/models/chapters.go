@@ -0,0 +1,45 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// ChapterModel is our interface with the chapters table.
+type ChapterModel struct {
+	DB *gorm.DB
+}
+
+// Replace swaps out all of an episode's chapters for the given ones.
+func (m *ChapterModel) Replace(episodeID uint, chapters []Chapter) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("episode_id = ?", episodeID).Delete(Chapter{}).Error
+		if err != nil {
+			return err
+		}
+
+		for _, c := range chapters {
+			c.ID = 0
+			c.EpisodeID = episodeID
+
+			err = tx.Create(&c).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// FindByEpisodeIDs gets the chapters for all of the given episodes, in
+// the order they appear in each episode.
+func (m *ChapterModel) FindByEpisodeIDs(episodeIDs []uint) ([]Chapter, error) {
+	var chapters []Chapter
+
+	err := m.DB.Where("episode_id IN (?)", episodeIDs).Order("episode_id, start_time").Find(&chapters).Error
+	if err != nil {
+		return chapters, err
+	}
+
+	return chapters, nil
+}
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -11,21 +15,457 @@ type EpisodeModel struct {
 	DB *gorm.DB
 }
 
-// Create adds a row in the episodes table.
-func (m *EpisodeModel) Create(title, guid, source string, duration, podcastID int, publishedOn time.Time) error {
-	episode := &Episode{
-		Title:       title,
-		GUID:        guid,
-		Source:      source,
-		Duration:    duration,
-		PodcastID:   podcastID,
-		PublishedOn: publishedOn,
+// EpisodeKey works out the key which identifies an episode within its
+// podcast. That's a hash of its GUID if it has one, or of its enclosure URL
+// and title if it doesn't. Hashing keeps the key a fixed length however
+// long the GUID is.
+func EpisodeKey(guid, source, title string) string {
+	var sum [sha1.Size]byte
+
+	if guid = strings.TrimSpace(guid); guid != "" {
+		sum = sha1.Sum([]byte("guid:" + guid))
+	} else {
+		sum = sha1.Sum([]byte("item:" + strings.TrimSpace(source) + "\n" + strings.TrimSpace(title)))
+	}
+
+	return hex.EncodeToString(sum[:])
+}
+
+// FindByPodcast gets all stored episodes for the given podcast.
+func (m *EpisodeModel) FindByPodcast(podcastID int) ([]Episode, error) {
+	var episodes []Episode
+
+	err := m.DB.Where("podcast_id = ?", podcastID).Find(&episodes).Error
+	if err != nil {
+		return episodes, err
+	}
+
+	return episodes, nil
+}
+
+// markRemoved records that the given episodes have disappeared from their
+// feed. Episodes that were already marked keep their original removal time.
+func markRemoved(db *gorm.DB, episodeIDs []uint) error {
+	return db.Model(&Episode{}).
+		Where("id IN (?) AND removed_at IS NULL", episodeIDs).
+		Update("removed_at", time.Now()).Error
+}
+
+// upsertBatchSize is how many episodes or revisions we write with each
+// INSERT, which keeps us well under the limit on placeholders in one
+// statement.
+const upsertBatchSize = 100
+
+// SaveFeed writes a feed's new and changed episodes, along with their
+// people and transcripts, gives episodes that have been reissued their new
+// GUIDs, records what changed about the ones we already had, and marks the
+// ones that have left the feed as removed, all in one transaction.
+// extras[i] holds the extras for episodes[i]. Reissued episodes are
+// rekeyed first, so that they're the rows their new versions update.
+// Episodes are written with multi-row upserts, so each is inserted, or
+// updates the row its podcast already has with the same key. Each
+// episode's ID is set to that of its row. Everything else is written with
+// multi-row inserts.
+func (m *EpisodeModel) SaveFeed(episodes []Episode, extras []EpisodeExtras, merges []EpisodeMerge, revisions []EpisodeRevision, removedIDs []uint) error {
+	if len(episodes) == 0 && len(merges) == 0 && len(revisions) == 0 && len(removedIDs) == 0 {
+		return nil
+	}
+
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := rekeyMerged(tx, merges)
+		if err != nil {
+			return err
+		}
+
+		for start := 0; start < len(episodes); start += upsertBatchSize {
+			end := start + upsertBatchSize
+			if end > len(episodes) {
+				end = len(episodes)
+			}
+
+			err := upsertEpisodes(tx, episodes[start:end])
+			if err != nil {
+				return err
+			}
+
+			err = replaceExtras(tx, episodes[start:end], extras[start:end])
+			if err != nil {
+				return err
+			}
+		}
+
+		err = insertRevisions(tx, revisions)
+		if err != nil {
+			return err
+		}
+
+		if len(removedIDs) > 0 {
+			return markRemoved(tx, removedIDs)
+		}
+
+		return nil
+	})
+}
+
+// upsertEpisodes writes a batch of episodes with a single statement, then
+// reads back their IDs, since we can't rely on the database to tell us
+// the IDs of rows that were updated rather than inserted.
+func upsertEpisodes(tx *gorm.DB, episodes []Episode) error {
+	var keys []string
+	var records []interface{}
+
+	scope := tx.NewScope(&Episode{})
+
+	for i := range episodes {
+		ep := &episodes[i]
+		if ep.ItemKey == "" {
+			ep.ItemKey = EpisodeKey(ep.GUID, ep.Source, ep.Title)
+		}
+		keys = append(keys, ep.ItemKey)
+		records = append(records, ep)
 	}
 
-	err := m.DB.Where(Episode{GUID: guid}).Assign(&episode).FirstOrCreate(&episode).Error
+	columns, rows, values := insertRows(tx, records)
+
+	onConflict, err := upsertClause(tx.Dialect().GetName(), scope, columns)
 	if err != nil {
 		return err
 	}
 
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s %s",
+		scope.QuotedTableName(), strings.Join(columns, ", "), rows, onConflict)
+
+	err = tx.Exec(sql, values...).Error
+	if err != nil {
+		return err
+	}
+
+	var saved []Episode
+	err = tx.Select("id, podcast_id, item_key").Where("item_key IN (?)", keys).Find(&saved).Error
+	if err != nil {
+		return err
+	}
+
+	ids := map[string]uint{}
+	for _, s := range saved {
+		ids[fmt.Sprintf("%d:%s", s.PodcastID, s.ItemKey)] = s.ID
+	}
+
+	for i := range episodes {
+		episodes[i].ID = ids[fmt.Sprintf("%d:%s", episodes[i].PodcastID, episodes[i].ItemKey)]
+	}
+
+	return nil
+}
+
+// rekeyMerged gives each reissued episode its new GUID and key, and logs
+// the merges.
+func rekeyMerged(tx *gorm.DB, merges []EpisodeMerge) error {
+	var records []interface{}
+	for i, merge := range merges {
+		err := tx.Model(&Episode{}).Where("id = ?", merge.EpisodeID).Updates(map[string]interface{}{
+			"guid":     merge.NewGUID,
+			"item_key": merge.NewKey,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		records = append(records, &merges[i])
+	}
+
+	return insertAll(tx, records)
+}
+
+// replaceExtras swaps out the people and transcripts of a batch of
+// episodes we've just written, and drops the chapters of any that no
+// longer link to them. Transcripts whose URL hasn't changed keep the text
+// we've already fetched for them.
+func replaceExtras(tx *gorm.DB, episodes []Episode, extras []EpisodeExtras) error {
+	var ids, unchaptered []uint
+	for _, ep := range episodes {
+		ids = append(ids, ep.ID)
+		if ep.ChaptersURL == "" {
+			unchaptered = append(unchaptered, ep.ID)
+		}
+	}
+
+	var existing []Transcript
+	err := tx.Where("episode_id IN (?)", ids).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+
+	fetched := make(map[string]Transcript, len(existing))
+	for _, t := range existing {
+		fetched[fmt.Sprintf("%d:%s", t.EpisodeID, t.URL)] = t
+	}
+
+	err = tx.Where("episode_id IN (?)", ids).Delete(Person{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("episode_id IN (?)", ids).Delete(Transcript{}).Error
+	if err != nil {
+		return err
+	}
+
+	if len(unchaptered) > 0 {
+		err = tx.Where("episode_id IN (?)", unchaptered).Delete(Chapter{}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	var people, transcripts []interface{}
+	for i, ep := range episodes {
+		for _, p := range extras[i].People {
+			p := p
+			p.ID = 0
+			p.PodcastID = ep.PodcastID
+			p.EpisodeID = ep.ID
+			people = append(people, &p)
+		}
+
+		for _, t := range extras[i].Transcripts {
+			t := t
+			t.ID = 0
+			t.EpisodeID = ep.ID
+			if f, ok := fetched[fmt.Sprintf("%d:%s", ep.ID, t.URL)]; ok {
+				t.Text = f.Text
+				t.FetchedAt = f.FetchedAt
+			}
+			transcripts = append(transcripts, &t)
+		}
+	}
+
+	err = insertAll(tx, people)
+	if err != nil {
+		return err
+	}
+
+	return insertAll(tx, transcripts)
+}
+
+// insertRevisions writes revisions with multi-row inserts.
+func insertRevisions(tx *gorm.DB, revisions []EpisodeRevision) error {
+	var records []interface{}
+	for i := range revisions {
+		records = append(records, &revisions[i])
+	}
+
+	return insertAll(tx, records)
+}
+
+// insertAll writes records of the same model with multi-row inserts, in
+// batches of upsertBatchSize.
+func insertAll(tx *gorm.DB, records []interface{}) error {
+	for start := 0; start < len(records); start += upsertBatchSize {
+		end := start + upsertBatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+
+		columns, rows, values := insertRows(tx, records[start:end])
+
+		sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s",
+			tx.NewScope(records[start]).QuotedTableName(), strings.Join(columns, ", "), rows)
+
+		err := tx.Exec(sql, values...).Error
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// insertRows builds the quoted columns and the rows of placeholders for
+// inserting records of the same model in one statement, along with the
+// values to go with them. Primary keys are left to the database.
+func insertRows(tx *gorm.DB, records []interface{}) ([]string, string, []interface{}) {
+	var columns, rows []string
+	var values []interface{}
+
+	for i, record := range records {
+		scope := tx.NewScope(record)
+
+		var marks []string
+		for _, field := range scope.Fields() {
+			if !field.IsNormal || field.IsIgnored || field.IsPrimaryKey {
+				continue
+			}
+
+			if i == 0 {
+				columns = append(columns, scope.Quote(field.DBName))
+			}
+
+			marks = append(marks, "?")
+			values = append(values, field.Field.Interface())
+		}
+
+		rows = append(rows, "("+strings.Join(marks, ", ")+")")
+	}
+
+	return columns, strings.Join(rows, ", "), values
+}
+
+// upsertClause builds the part of an upsert which says to update the
+// existing row when an episode's podcast and key are already taken.
+func upsertClause(dialect string, scope *gorm.Scope, columns []string) (string, error) {
+	var sets []string
+
+	switch dialect {
+	case "mysql":
+		for _, c := range columns {
+			sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", c, c))
+		}
+
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", "), nil
+	case "postgres", "sqlite3":
+		for _, c := range columns {
+			sets = append(sets, fmt.Sprintf("%s = excluded.%s", c, c))
+		}
+
+		return fmt.Sprintf("ON CONFLICT (%s, %s) DO UPDATE SET %s",
+			scope.Quote("podcast_id"), scope.Quote("item_key"), strings.Join(sets, ", ")), nil
+	default:
+		return "", fmt.Errorf("upserting episodes isn't supported on %s", dialect)
+	}
+}
+
+// Merges gets the log of episodes in a podcast that were recognised under
+// a new GUID, most recent first.
+func (m *EpisodeModel) Merges(podcastID int) ([]EpisodeMerge, error) {
+	var merges []EpisodeMerge
+
+	err := m.DB.Where("podcast_id = ?", podcastID).Order("merged_at DESC").Find(&merges).Error
+	if err != nil {
+		return merges, err
+	}
+
+	return merges, nil
+}
+
+// Get finds an episode by its ID.
+func (m *EpisodeModel) Get(episodeID uint) (Episode, error) {
+	var episode Episode
+	err := m.DB.First(&episode, "id = ?", episodeID).Error
+
+	return episode, err
+}
+
+// Revisions gets the history of changes to an episode, most recent first.
+func (m *EpisodeModel) Revisions(episodeID uint) ([]EpisodeRevision, error) {
+	var revisions []EpisodeRevision
+
+	err := m.DB.Where("episode_id = ?", episodeID).Order("changed_at DESC, id").Find(&revisions).Error
+	if err != nil {
+		return revisions, err
+	}
+
+	return revisions, nil
+}
+
+// RevisionCounts gets how many times each of a podcast's episodes has
+// changed, keyed by episode ID. Episodes that have never changed are left
+// out.
+func (m *EpisodeModel) RevisionCounts(podcastID int) (map[uint]int, error) {
+	var rows []struct {
+		EpisodeID uint
+		Revisions int
+	}
+
+	counts := map[uint]int{}
+
+	err := m.DB.Table("episode_revisions").
+		Select("episode_id, COUNT(DISTINCT changed_at) AS revisions").
+		Where("podcast_id = ?", podcastID).
+		Group("episode_id").
+		Scan(&rows).Error
+	if err != nil {
+		return counts, err
+	}
+
+	for _, row := range rows {
+		counts[row.EpisodeID] = row.Revisions
+	}
+
+	return counts, nil
+}
+
+// RecentPublishDates gets the publish dates of a podcast's most recent
+// episodes, newest first, leaving out any that have been removed.
+func (m *EpisodeModel) RecentPublishDates(podcastID int, limit int) ([]time.Time, error) {
+	var dates []time.Time
+
+	err := m.DB.Model(&Episode{}).
+		Where("podcast_id = ? AND removed_at IS NULL", podcastID).
+		Order("published_on DESC").
+		Limit(limit).
+		Pluck("published_on", &dates).Error
+	if err != nil {
+		return dates, err
+	}
+
+	return dates, nil
+}
+
+// FindChaptersUnfetched gets a podcast's episodes that link to chapters
+// we haven't downloaded yet, newest first.
+func (m *EpisodeModel) FindChaptersUnfetched(podcastID int, limit int) ([]Episode, error) {
+	var episodes []Episode
+
+	err := m.DB.
+		Where("podcast_id = ? AND chapters_url <> '' AND chapters_fetched_at IS NULL AND removed_at IS NULL", podcastID).
+		Order("published_on DESC").
+		Limit(limit).
+		Find(&episodes).Error
+	if err != nil {
+		return episodes, err
+	}
+
+	return episodes, nil
+}
+
+// SetChaptersFetched records that we've downloaded an episode's chapters
+// from the given URL. If the episode has moved on to another URL since,
+// it's left for that one to be fetched.
+func (m *EpisodeModel) SetChaptersFetched(episodeID uint, chaptersURL string) error {
+	return m.DB.Model(&Episode{}).
+		Where("id = ? AND chapters_url = ?", episodeID, chaptersURL).
+		Update("chapters_fetched_at", time.Now()).Error
+}
+
+// FindUnprobed gets episodes that don't have a duration and that we
+// haven't yet tried to probe one for, newest first.
+func (m *EpisodeModel) FindUnprobed(limit int) ([]Episode, error) {
+	var episodes []Episode
+
+	err := m.DB.
+		Where("duration = 0 AND duration_probed_at IS NULL AND removed_at IS NULL AND source <> ''").
+		Order("published_on DESC").
+		Limit(limit).
+		Find(&episodes).Error
+	if err != nil {
+		return episodes, err
+	}
+
+	return episodes, nil
+}
+
+// SetProbedDuration records that we've probed an episode's enclosure for
+// its duration, storing the duration if we found one.
+func (m *EpisodeModel) SetProbedDuration(episodeID uint, secs int) error {
+	updates := map[string]interface{}{
+		"duration_probed_at": time.Now(),
+	}
+
+	if secs > 0 {
+		updates["duration"] = secs
+		updates["duration_source"] = DurationProbed
+	}
+
+	return m.DB.Model(&Episode{}).Where("id = ?", episodeID).Updates(updates).Error
+}
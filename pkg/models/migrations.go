@@ -0,0 +1,122 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// RepairEpisodeIdentity moves the episodes table over from identifying
+// episodes by a globally unique GUID to identifying them by podcast and
+// item key. It drops the old unique index on guid, widens the guid column
+// and fills in the key for any rows which don't have one yet, then makes
+// sure the new unique index exists. It's safe to run on every start.
+//
+// Episodes which were overwritten by another podcast's episode with the
+// same GUID can't be recovered here, but they'll be recreated the next
+// time their podcast is refreshed.
+func RepairEpisodeIdentity(db *gorm.DB) error {
+	dialect := db.Dialect()
+
+	if dialect.HasIndex("episodes", "uix_episodes_guid") {
+		err := db.Model(&Episode{}).RemoveIndex("uix_episodes_guid").Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Model(&Episode{}).ModifyColumn("guid", "varchar(2048)").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		var episodes []Episode
+
+		err := db.Select("id, guid, source, title").
+			Where("item_key IS NULL OR item_key = ''").
+			Limit(500).
+			Find(&episodes).Error
+		if err != nil {
+			return err
+		}
+
+		if len(episodes) == 0 {
+			break
+		}
+
+		for _, ep := range episodes {
+			key := EpisodeKey(ep.GUID, ep.Source, ep.Title)
+
+			err = db.Model(&Episode{}).Where("id = ?", ep.ID).Update("item_key", key).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !dialect.HasIndex("episodes", "episode_identity") {
+		return db.Model(&Episode{}).AddUniqueIndex("episode_identity", "podcast_id", "item_key").Error
+	}
+
+	return nil
+}
+
+// WidenEpisodeColumns turns the episodes table's title and URL columns
+// from varchar(255) into text, since feeds have titles and URLs longer
+// than that. Migrating the tables only ever adds columns, so databases
+// made before then need changing here. It's only needed for MySQL, and
+// it's safe to run on every start.
+func WidenEpisodeColumns(db *gorm.DB) error {
+	if db.Dialect().GetName() != "mysql" {
+		return nil
+	}
+
+	for _, column := range []string{"title", "source", "image_url", "chapters_url"} {
+		var dataType string
+
+		err := db.Raw(
+			"SELECT data_type FROM information_schema.columns WHERE table_schema = ? AND table_name = ? AND column_name = ?",
+			db.Dialect().CurrentDatabase(), "episodes", column,
+		).Row().Scan(&dataType)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if dataType != "varchar" {
+			continue
+		}
+
+		err = db.Model(&Episode{}).ModifyColumn(column, "text").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LinkITunesIDs moves the podcasts table over from using the iTunes
+// collection ID as the podcast's ID to keeping it in its own column, so
+// podcasts can be added which aren't on iTunes. Every podcast saved before
+// then came from iTunes, so their IDs are copied across when the column is
+// added. It needs to run before the tables are migrated, and it's safe to
+// run on every start.
+func LinkITunesIDs(db *gorm.DB) error {
+	dialect := db.Dialect()
+
+	if !dialect.HasTable("podcasts") || dialect.HasColumn("podcasts", "itunes_id") {
+		return nil
+	}
+
+	err := db.AutoMigrate(&Podcast{}).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Exec("UPDATE podcasts SET itunes_id = id").Error
+}
@@ -26,14 +26,96 @@ type User struct {
 	Subscriptions []Subscription
 }
 
-// Podcast is a single podcast from iTunes.
+// Podcast is a single podcast. ID is our own, and ITunesID is the iTunes
+// collection ID, if we know it: podcasts added by their feed URL get one
+// once they turn up in an iTunes search. Alongside the details of the
+// podcast itself, we keep track of how fetching its feed has been going:
+// FailingSince is set on the first of a run of failed fetches and cleared
+// once a fetch succeeds.
+//
+// Private podcasts belong to the user in OwnerID, and are that user's own
+// copy of a show whose feed needs credentials. Their feed URL, with any
+// credentials, is kept encrypted in FeedSecret, and Feed only holds the
+// scheme and host, so that it's safe to show and log.
 type Podcast struct {
-	ID       int `gorm:"primary_key"`
-	Name     string
-	Feed     string
+	ID           int   `gorm:"primary_key"`
+	ITunesID     *int  `gorm:"column:itunes_id;unique_index:podcast_itunes_id"`
+	OwnerID      *uint `gorm:"index:podcast_owner_id"`
+	Name         string
+	Feed         string
+	FeedSecret   string `gorm:"type:text"`
+	ETag         string
+	LastModified string
+	FeedHash     string     `gorm:"type:char(64)"`
+	PodcastGUID  string     `gorm:"type:varchar(36)"`
+	NextFetchAt  *time.Time `gorm:"index:podcast_next_fetch_at"`
+
+	// Details from the feed's channel, refreshed whenever the feed changes.
+	// Categories are comma-separated, with subcategories as "Parent > Child".
+	Title         string
+	Description   string `gorm:"type:text"`
+	Author        string
+	OwnerName     string
+	OwnerEmail    string
+	Link          string
+	Language      string
+	Categories    string `gorm:"type:text"`
+	Explicit      bool
+	ArtworkURL    string
+	LastBuildDate *time.Time
+
+	// The WebSub hub the feed is pushed from, if it has one. HubSecret signs
+	// what the hub sends us, and HubLeaseExpiresAt is only set once the hub
+	// has confirmed the subscription. HubRequestedAt is set while we're
+	// waiting for the hub to confirm a subscription we've asked for.
+	// HubRenewalFailures counts the attempts to renew the lease that have
+	// failed in a row.
+	HubURL             string
+	HubTopic           string
+	HubSecret          string     `gorm:"type:varchar(64)"`
+	HubLeaseExpiresAt  *time.Time `gorm:"index:podcast_hub_lease_expires_at"`
+	HubRequestedAt     *time.Time
+	HubRenewalFailures int
+
+	LastFetchAt         *time.Time
+	LastSuccessAt       *time.Time
+	FailingSince        *time.Time
+	ConsecutiveFailures int
+	LastStatus          int
+	LastError           string `gorm:"type:varchar(1024)"`
+	ParseWarnings       string `gorm:"type:text"`
+
 	Episodes []Episode
 }
 
+// Private checks whether a podcast is a user's private copy of a show.
+func (p Podcast) Private() bool {
+	return p.OwnerID != nil
+}
+
+// VisibleTo checks whether a user is allowed to see a podcast. Anyone can
+// see a podcast unless it's private, in which case only its owner can.
+func (p Podcast) VisibleTo(userID uint) bool {
+	return p.OwnerID == nil || *p.OwnerID == userID
+}
+
+// The reasons a podcast's feed can move.
+const (
+	FeedMoveRedirect   = "redirect"
+	FeedMoveNewFeedURL = "new-feed-url"
+)
+
+// FeedMove records a podcast's feed moving from one URL to another. For
+// private podcasts, only the scheme and host of each URL are recorded.
+type FeedMove struct {
+	ID        uint `gorm:"primary_key"`
+	PodcastID int  `gorm:"index:feed_move_podcast_id"`
+	OldURL    string
+	NewURL    string
+	Reason    string
+	MovedAt   time.Time
+}
+
 // Subscription represents a relationship between a user and a podcast.
 type Subscription struct {
 	UserID    uint `gorm:"index:subscription_user_id"`
@@ -41,15 +123,118 @@ type Subscription struct {
 	Podcast   Podcast
 }
 
-// Episode is a single podcast episode.
+// Episode is a single podcast episode. Episodes are identified by their
+// ItemKey within their podcast; see EpisodeKey. RemovedAt is set when the
+// episode disappears from its feed, and cleared if it comes back.
 type Episode struct {
-	ID          uint   `gorm:"primary_key"`
-	PodcastID   int    `gorm:"index:episode_podcast_id"`
-	GUID        string `gorm:"type:varchar(100);unique_index"`
-	Title       string
-	Source      string
-	PublishedOn time.Time
-	Duration    int
+	ID              uint   `gorm:"primary_key"`
+	PodcastID       int    `gorm:"index:episode_podcast_id;unique_index:episode_identity"`
+	GUID            string `gorm:"type:varchar(2048)"`
+	ItemKey         string `gorm:"type:char(40);unique_index:episode_identity"`
+	Title           string `gorm:"type:text"`
+	Source          string `gorm:"type:text"`
+	PublishedOn     time.Time
+	Duration        int
+	EpisodeNumber   int
+	Season          int
+	EpisodeType     string `gorm:"type:varchar(10);default:'full'"`
+	Explicit        bool
+	ImageURL        string `gorm:"type:text"`
+	Summary         string `gorm:"type:text"`
+	Description     string `gorm:"type:mediumtext"`
+	EnclosureLength int64
+	EnclosureType   string
+	SeasonName      string
+	ChaptersURL     string `gorm:"type:text"`
+	ChaptersType    string
+	RemovedAt       *time.Time
+
+	// ChaptersFetchedAt is set once we've downloaded and read the chapters
+	// at ChaptersURL, and cleared whenever ChaptersURL changes.
+	ChaptersFetchedAt *time.Time
+
+	// DurationSource says where Duration came from, if we know it at all.
+	// DurationProbedAt is set once we've tried to probe the duration from
+	// the enclosure, whether or not that worked.
+	DurationSource   string `gorm:"type:varchar(10)"`
+	DurationProbedAt *time.Time
+}
+
+// Where an episode's duration came from.
+const (
+	DurationFromFeed = "feed"
+	DurationProbed   = "probed"
+)
+
+// EpisodeMerge records an episode being recognised under a new GUID.
+// EpisodeID is the row that was given the new GUID, and NewKey the key
+// that goes with it, which isn't logged.
+type EpisodeMerge struct {
+	ID        uint `gorm:"primary_key"`
+	PodcastID int  `gorm:"index:episode_merge_podcast_id"`
+	EpisodeID uint
+	OldGUID   string `gorm:"type:varchar(2048)"`
+	NewGUID   string `gorm:"type:varchar(2048)"`
+	NewKey    string `gorm:"-"`
+	MatchedBy string
+	MergedAt  time.Time
+}
+
+// EpisodeRevision records one of an episode's details changing in its
+// feed. Field is the episode's column, and the values are as they'd be
+// written in a feed, like seconds for durations. Everything that changed
+// in the same fetch shares a ChangedAt.
+type EpisodeRevision struct {
+	ID        uint `gorm:"primary_key"`
+	PodcastID int  `gorm:"index:episode_revision_podcast_id"`
+	EpisodeID uint `gorm:"index:episode_revision_episode_id"`
+	Field     string
+	OldValue  string `gorm:"type:mediumtext"`
+	NewValue  string `gorm:"type:mediumtext"`
+	ChangedAt time.Time
+}
+
+// Chapter is a single chapter marker within an episode.
+type Chapter struct {
+	ID        uint `gorm:"primary_key"`
+	EpisodeID uint `gorm:"index:chapter_episode_id"`
+	StartTime float64
+	Title     string
+	ImageURL  string
+	URL       string
+}
+
+// Transcript is a transcript of an episode. Text holds the plain-text
+// version of whatever format the transcript was published in.
+type Transcript struct {
+	ID        uint `gorm:"primary_key"`
+	EpisodeID uint `gorm:"index:transcript_episode_id"`
+	URL       string
+	Type      string
+	Language  string
+	Rel       string
+	Text      string `gorm:"type:mediumtext"`
+	FetchedAt *time.Time
+}
+
+// Person is someone who appears on a podcast. People listed against the
+// whole podcast, like its hosts, have an EpisodeID of 0.
+type Person struct {
+	ID        uint `gorm:"primary_key"`
+	PodcastID int  `gorm:"index:person_podcast_id"`
+	EpisodeID uint `gorm:"index:person_episode_id"`
+	Name      string
+	Role      string
+	Group     string `gorm:"column:person_group"`
+	ImageURL  string
+	Href      string
+}
+
+// EpisodeExtras are the people and transcripts listed against an episode
+// in its feed, to be saved along with it.
+type EpisodeExtras struct {
+	People      []Person
+	Transcripts []Transcript
 }
 
 // Listen is a single episode listen for a user.
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// PersonModel is our interface with the people table.
+type PersonModel struct {
+	DB *gorm.DB
+}
+
+// PersonListens is a person along with how many of their episodes a user
+// has listened to.
+type PersonListens struct {
+	Name     string
+	ImageURL string
+	Listens  int
+}
+
+// Replace swaps out everyone listed against an episode for the given
+// people. Pass an episodeID of 0 to replace the people listed against the
+// whole podcast.
+func (m *PersonModel) Replace(podcastID int, episodeID uint, people []Person) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("podcast_id = ? AND episode_id = ?", podcastID, episodeID).Delete(Person{}).Error
+		if err != nil {
+			return err
+		}
+
+		for _, p := range people {
+			p.ID = 0
+			p.PodcastID = podcastID
+			p.EpisodeID = episodeID
+
+			err = tx.Create(&p).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// FindByPodcast gets everyone listed against a podcast or any of its
+// episodes.
+func (m *PersonModel) FindByPodcast(podcastID int) ([]Person, error) {
+	var people []Person
+
+	err := m.DB.Where("podcast_id = ?", podcastID).Order("id").Find(&people).Error
+	if err != nil {
+		return people, err
+	}
+
+	return people, nil
+}
+
+// MostListened gets the people with the given role, like "guest", who
+// appear on the most episodes the user has listened to.
+func (m *PersonModel) MostListened(userID uint, role string, limit int) ([]PersonListens, error) {
+	var people []PersonListens
+
+	err := m.DB.Table("people").
+		Select("people.name, MAX(people.image_url) AS image_url, COUNT(DISTINCT listens.episode_id) AS listens").
+		Joins("JOIN listens ON listens.episode_id = people.episode_id").
+		Where("listens.user_id = ? AND people.role = ?", userID, role).
+		Group("people.name").
+		Order("listens DESC").
+		Limit(limit).
+		Scan(&people).Error
+	if err != nil {
+		return people, err
+	}
+
+	return people, nil
+}
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
 	"github.com/jinzhu/gorm"
 )
 
@@ -9,20 +13,98 @@ type PodcastModel struct {
 	DB *gorm.DB
 }
 
-// Create inserts a new podcast into the database.
-func (m *PodcastModel) Create(ID int, collectionName, feed string) error {
-	podcast := &Podcast{
-		ID:   ID,
-		Name: collectionName,
+// CreateFromITunes saves a podcast from an iTunes search result and
+// returns it. If we already have the podcast, either from an earlier search
+// or because it was added by its feed URL, that podcast is linked to the
+// iTunes collection rather than a new one being created. We don't take the
+// feed URL from iTunes for podcasts we already have, since we follow feed
+// moves ourselves and iTunes is often behind.
+func (m *PodcastModel) CreateFromITunes(itunesID int, collectionName, feed string) (Podcast, error) {
+	var podcast Podcast
+
+	err := m.DB.Where("itunes_id = ?", itunesID).First(&podcast).Error
+	if err == nil {
+		return podcast, m.DB.Model(&podcast).Update("name", collectionName).Error
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return podcast, err
+	}
+
+	podcast, err = m.FindByFeed(feed)
+	if err == nil && podcast.ITunesID == nil {
+		podcast.ITunesID = &itunesID
+
+		return podcast, m.DB.Model(&podcast).Update("itunes_id", itunesID).Error
+	}
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return podcast, err
+	}
+
+	podcast = Podcast{
+		ITunesID: &itunesID,
+		Name:     collectionName,
+		Feed:     feed,
+	}
+
+	return podcast, m.DB.Create(&podcast).Error
+}
+
+// CreateFromFeed saves a podcast that's been added by its feed URL and
+// returns it. If we already have a podcast with the feed, we return that
+// one instead.
+func (m *PodcastModel) CreateFromFeed(name, feed string) (Podcast, error) {
+	podcast, err := m.FindByFeed(feed)
+	if err == nil || !gorm.IsRecordNotFoundError(err) {
+		return podcast, err
+	}
+
+	podcast = Podcast{
+		Name: name,
 		Feed: feed,
 	}
 
-	err := m.DB.Where(Podcast{ID: ID}).Assign(&podcast).FirstOrCreate(&podcast).Error
+	return podcast, m.DB.Create(&podcast).Error
+}
+
+// CreatePrivate saves a user's private copy of a podcast and returns it.
+// The feed is the URL to show for it, and the secret is the encrypted URL
+// we actually fetch.
+func (m *PodcastModel) CreatePrivate(ownerID uint, name, feed, secret string) (Podcast, error) {
+	podcast := Podcast{
+		OwnerID:    &ownerID,
+		Name:       name,
+		Feed:       feed,
+		FeedSecret: secret,
+	}
+
+	return podcast, m.DB.Create(&podcast).Error
+}
+
+// FindByFeed gets a podcast by its feed URL, including any URL its feed
+// has moved away from. Private podcasts are never matched.
+func (m *PodcastModel) FindByFeed(feed string) (Podcast, error) {
+	var podcast Podcast
+
+	moved := m.DB.Table("feed_moves").Select("podcast_id").Where("old_url = ?", feed).QueryExpr()
+	err := m.DB.
+		Where("owner_id IS NULL").
+		Where("feed = ? OR id IN (?)", feed, moved).
+		Order("id").
+		First(&podcast).Error
+
+	return podcast, err
+}
+
+// FindPrivate gets all of a user's private podcasts.
+func (m *PodcastModel) FindPrivate(ownerID uint) ([]Podcast, error) {
+	var podcasts []Podcast
+
+	err := m.DB.Where("owner_id = ?", ownerID).Order("id").Find(&podcasts).Error
 	if err != nil {
-		return m.DB.Error
+		return podcasts, err
 	}
 
-	return nil
+	return podcasts, nil
 }
 
 // Find gets a single podcast by collectionID.
@@ -32,3 +114,228 @@ func (m *PodcastModel) Find(collectionID int) (Podcast, error) {
 
 	return podcast, err
 }
+
+// UpdateValidators stores the caching headers and content hash from the
+// most recent fetch of a podcast's feed.
+func (m *PodcastModel) UpdateValidators(collectionID int, etag, lastModified, hash string) error {
+	return m.DB.Model(&Podcast{}).Where("id = ?", collectionID).Updates(map[string]interface{}{
+		"e_tag":         etag,
+		"last_modified": lastModified,
+		"feed_hash":     hash,
+	}).Error
+}
+
+// UpdateChannel stores the details from a podcast feed's channel. Every
+// detail is written, so ones that have been dropped from the feed are
+// cleared.
+func (m *PodcastModel) UpdateChannel(collectionID int, details Podcast) error {
+	return m.DB.Model(&Podcast{}).Where("id = ?", collectionID).Updates(map[string]interface{}{
+		"title":           details.Title,
+		"description":     details.Description,
+		"author":          details.Author,
+		"owner_name":      details.OwnerName,
+		"owner_email":     details.OwnerEmail,
+		"link":            details.Link,
+		"language":        details.Language,
+		"categories":      details.Categories,
+		"explicit":        details.Explicit,
+		"artwork_url":     details.ArtworkURL,
+		"last_build_date": details.LastBuildDate,
+		"podcast_guid":    details.PodcastGUID,
+	}).Error
+}
+
+// MoveFeed points a podcast at a new feed URL and records the move. The
+// stored validators belong to the old URL, so they're cleared.
+func (m *PodcastModel) MoveFeed(collectionID int, oldURL, newURL, reason string) error {
+	return m.moveFeed(collectionID, oldURL, newURL, reason, map[string]interface{}{})
+}
+
+// MovePrivateFeed points a private podcast at a new feed URL, given
+// encrypted as the secret, and records the move. The old and new URLs are
+// the ones to show for the feed, not the real ones.
+func (m *PodcastModel) MovePrivateFeed(collectionID int, oldURL, newURL, secret, reason string) error {
+	return m.moveFeed(collectionID, oldURL, newURL, reason, map[string]interface{}{
+		"feed_secret": secret,
+	})
+}
+
+// moveFeed records a feed move and applies it to the podcast, along with
+// any other updates.
+func (m *PodcastModel) moveFeed(collectionID int, oldURL, newURL, reason string, updates map[string]interface{}) error {
+	updates["feed"] = newURL
+	updates["e_tag"] = ""
+	updates["last_modified"] = ""
+	updates["feed_hash"] = ""
+
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&FeedMove{
+			PodcastID: collectionID,
+			OldURL:    oldURL,
+			NewURL:    newURL,
+			Reason:    reason,
+			MovedAt:   time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&Podcast{}).Where("id = ?", collectionID).Updates(updates).Error
+	})
+}
+
+// FeedMoves gets the history of a podcast's feed URL, most recent first.
+func (m *PodcastModel) FeedMoves(collectionID int) ([]FeedMove, error) {
+	var moves []FeedMove
+
+	err := m.DB.Where("podcast_id = ?", collectionID).Order("moved_at DESC").Find(&moves).Error
+	if err != nil {
+		return moves, err
+	}
+
+	return moves, nil
+}
+
+// FindDue gets podcasts that at least one user is subscribed to and that
+// are due to be refreshed, soonest first. Podcasts which have never been
+// scheduled are included.
+func (m *PodcastModel) FindDue(now time.Time, limit int) ([]Podcast, error) {
+	var podcasts []Podcast
+
+	err := m.DB.
+		Where("id IN (?)", m.DB.Table("subscriptions").Select("podcast_id").QueryExpr()).
+		Where("next_fetch_at IS NULL OR next_fetch_at <= ?", now).
+		Order("next_fetch_at").
+		Limit(limit).
+		Find(&podcasts).Error
+	if err != nil {
+		return podcasts, err
+	}
+
+	return podcasts, nil
+}
+
+// ScheduleFetch sets when a podcast should next be refreshed.
+func (m *PodcastModel) ScheduleFetch(collectionID int, at time.Time) error {
+	return m.DB.Model(&Podcast{}).Where("id = ?", collectionID).Update("next_fetch_at", at).Error
+}
+
+// Get finds a podcast by its ID without loading its episodes.
+func (m *PodcastModel) Get(collectionID int) (Podcast, error) {
+	var podcast Podcast
+	err := m.DB.First(&podcast, "id = ?", collectionID).Error
+
+	return podcast, err
+}
+
+// FetchOutcome is how a single attempt to fetch a podcast's feed went.
+// Status is the HTTP status of the response, or zero if we didn't get
+// one, and Warnings are any problems with the feed that didn't stop it
+// being saved. If the feed hadn't changed, NotModified is set and the
+// warnings from the last time it changed are kept.
+type FetchOutcome struct {
+	At          time.Time
+	Status      int
+	Err         error
+	NotModified bool
+	Warnings    []string
+}
+
+// maxErrorLength is the most of an error message we'll store.
+const maxErrorLength = 1024
+
+// RecordFetch stores the outcome of fetching a podcast's feed.
+func (m *PodcastModel) RecordFetch(collectionID int, outcome FetchOutcome) error {
+	updates := map[string]interface{}{
+		"last_fetch_at": outcome.At,
+		"last_status":   outcome.Status,
+	}
+
+	if outcome.Err == nil {
+		updates["last_success_at"] = outcome.At
+		updates["failing_since"] = nil
+		updates["consecutive_failures"] = 0
+		updates["last_error"] = ""
+
+		if !outcome.NotModified {
+			updates["parse_warnings"] = strings.Join(outcome.Warnings, "\n")
+		}
+	} else {
+		// Cut long messages short at the start of a character, so we never
+		// store half of one.
+		msg := outcome.Err.Error()
+		if len(msg) > maxErrorLength {
+			end := maxErrorLength
+			for end > 0 && !utf8.RuneStart(msg[end]) {
+				end--
+			}
+			msg = msg[:end]
+		}
+
+		updates["failing_since"] = gorm.Expr("COALESCE(failing_since, ?)", outcome.At)
+		updates["consecutive_failures"] = gorm.Expr("consecutive_failures + 1")
+		updates["last_error"] = msg
+	}
+
+	return m.DB.Model(&Podcast{}).Where("id = ?", collectionID).Updates(updates).Error
+}
+
+// SetHub records that we've asked a WebSub hub to push a podcast's feed
+// to us. Any lease from an earlier subscription no longer applies.
+func (m *PodcastModel) SetHub(collectionID int, hub, topic, secret string) error {
+	return m.DB.Model(&Podcast{}).Where("id = ?", collectionID).Updates(map[string]interface{}{
+		"hub_url":              hub,
+		"hub_topic":            topic,
+		"hub_secret":           secret,
+		"hub_lease_expires_at": nil,
+		"hub_requested_at":     nil,
+		"hub_renewal_failures": 0,
+	}).Error
+}
+
+// RequestHub records that we've asked the hub for a podcast's
+// subscription, and are waiting for it to confirm.
+func (m *PodcastModel) RequestHub(collectionID int, requestedAt time.Time) error {
+	return m.DB.Model(&Podcast{}).Where("id = ?", collectionID).
+		UpdateColumn("hub_requested_at", requestedAt).Error
+}
+
+// ConfirmHub records that the hub has confirmed a podcast's subscription,
+// and until when.
+func (m *PodcastModel) ConfirmHub(collectionID int, expiresAt time.Time) error {
+	return m.DB.Model(&Podcast{}).Where("id = ?", collectionID).Updates(map[string]interface{}{
+		"hub_lease_expires_at": expiresAt,
+		"hub_requested_at":     nil,
+		"hub_renewal_failures": 0,
+	}).Error
+}
+
+// FailHubRenewal records that we couldn't renew a podcast's WebSub lease.
+func (m *PodcastModel) FailHubRenewal(collectionID int) error {
+	return m.DB.Model(&Podcast{}).Where("id = ?", collectionID).
+		UpdateColumn("hub_renewal_failures", gorm.Expr("hub_renewal_failures + 1")).Error
+}
+
+// ClearHub forgets a podcast's WebSub subscription.
+func (m *PodcastModel) ClearHub(collectionID int) error {
+	return m.SetHub(collectionID, "", "", "")
+}
+
+// FindExpiringLeases gets podcasts that at least one user is subscribed
+// to and whose WebSub subscriptions run out between the given times,
+// soonest first. Leases that ran out before then are left alone.
+func (m *PodcastModel) FindExpiringLeases(after, before time.Time, limit int) ([]Podcast, error) {
+	var podcasts []Podcast
+
+	err := m.DB.
+		Where("id IN (?)", m.DB.Table("subscriptions").Select("podcast_id").QueryExpr()).
+		Where("hub_url <> '' AND hub_lease_expires_at > ? AND hub_lease_expires_at <= ?", after, before).
+		Order("hub_lease_expires_at").
+		Limit(limit).
+		Find(&podcasts).Error
+	if err != nil {
+		return podcasts, err
+	}
+
+	return podcasts, nil
+}
@@ -24,6 +24,49 @@ func (m *SubscriptionModel) Create(podcastID int, userID uint) error {
 	return nil
 }
 
+// CreateMany subscribes a user to several podcasts in a single
+// transaction, and returns the IDs of the podcasts they weren't already
+// subscribed to.
+func (m *SubscriptionModel) CreateMany(userID uint, podcastIDs []int) ([]int, error) {
+	var added []int
+
+	if len(podcastIDs) == 0 {
+		return added, nil
+	}
+
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		var existing []Subscription
+
+		err := tx.Where("user_id = ? AND podcast_id IN (?)", userID, podcastIDs).Find(&existing).Error
+		if err != nil {
+			return err
+		}
+
+		subscribed := map[int]bool{}
+		for _, s := range existing {
+			subscribed[s.PodcastID] = true
+		}
+
+		for _, id := range podcastIDs {
+			if subscribed[id] {
+				continue
+			}
+
+			err = tx.Create(&Subscription{UserID: userID, PodcastID: id}).Error
+			if err != nil {
+				return err
+			}
+
+			subscribed[id] = true
+			added = append(added, id)
+		}
+
+		return nil
+	})
+
+	return added, err
+}
+
 // Find finds a subscription by collectionID and userID.
 func (m *SubscriptionModel) Find(collectionID int, userID uint) (Subscription, error) {
 	var subscription Subscription
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// TranscriptModel is our interface with the transcripts table.
+type TranscriptModel struct {
+	DB *gorm.DB
+}
+
+// FindByEpisodeIDs gets the transcripts for all of the given episodes.
+func (m *TranscriptModel) FindByEpisodeIDs(episodeIDs []uint) ([]Transcript, error) {
+	var transcripts []Transcript
+
+	err := m.DB.Where("episode_id IN (?)", episodeIDs).Order("id").Find(&transcripts).Error
+	if err != nil {
+		return transcripts, err
+	}
+
+	return transcripts, nil
+}
+
+// FindUnfetched gets transcripts of a podcast's episodes that we haven't
+// downloaded the text of yet.
+func (m *TranscriptModel) FindUnfetched(podcastID int, limit int) ([]Transcript, error) {
+	var transcripts []Transcript
+
+	err := m.DB.
+		Where("episode_id IN (?)", m.DB.Table("episodes").Select("id").Where("podcast_id = ? AND removed_at IS NULL", podcastID).QueryExpr()).
+		Where("fetched_at IS NULL").
+		Order("episode_id DESC").
+		Limit(limit).
+		Find(&transcripts).Error
+	if err != nil {
+		return transcripts, err
+	}
+
+	return transcripts, nil
+}
+
+// SetText stores the downloaded text of a transcript.
+func (m *TranscriptModel) SetText(id uint, text string) error {
+	return m.DB.Model(&Transcript{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"text":       text,
+		"fetched_at": time.Now(),
+	}).Error
+}